@@ -0,0 +1,76 @@
+package dashmiddleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// Ways to handle a recorded request when MaxConcurrentRecorded is reached,
+// or a layout request when MaxConcurrentLayoutLookups is.
+const (
+	backpressureWait   = "wait"
+	backpressureReject = "reject"
+)
+
+// acquireRecorded takes a slot for a recorded request, the returned function releases it.
+// It returns false when the request was answered with a 429 or its client went away.
+func (c *DashMiddleware) acquireRecorded(responseWriter http.ResponseWriter, req *http.Request) (func(), bool) {
+	if c.recordedSlots == nil {
+		return func() {}, true
+	}
+
+	release := func() { <-c.recordedSlots }
+
+	select {
+	case c.recordedSlots <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	if c.backpressureMode == backpressureReject {
+		c.metrics.inc("dashmiddleware_backpressure_total", "mode", backpressureReject)
+		responseWriter.Header().Set("Retry-After", strconv.Itoa(c.backpressureRetryAfter))
+		http.Error(responseWriter, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	c.metrics.inc("dashmiddleware_backpressure_total", "mode", backpressureWait)
+	select {
+	case c.recordedSlots <- struct{}{}:
+		return release, true
+	case <-req.Context().Done():
+		return nil, false
+	}
+}
+
+// acquireLayout takes a slot for a layout lookup, the returned function releases it.
+// It returns false when no slot is free in reject mode or none got free within the layout
+// queue timeout, so a slow layout backend does not hold the waiting requests until their clients give up.
+func (c *DashMiddleware) acquireLayout(ctx context.Context) (func(), bool) {
+	if c.layoutSlots == nil {
+		return func() {}, true
+	}
+
+	release := func() { <-c.layoutSlots }
+
+	select {
+	case c.layoutSlots <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	c.metrics.inc("dashmiddleware_layout_backpressure_total", "mode", c.layoutBackpressureMode)
+	if c.layoutBackpressureMode == backpressureReject {
+		return nil, false
+	}
+
+	wait, cancel := c.withCallTimeout(ctx, c.layoutQueueTimeout)
+	defer cancel()
+	select {
+	case c.layoutSlots <- struct{}{}:
+		return release, true
+	case <-wait.Done():
+		return nil, false
+	}
+}
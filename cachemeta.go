@@ -0,0 +1,54 @@
+package dashmiddleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// cacheMetadata the object injected as _dashpool into cached JSON responses.
+type cacheMetadata struct {
+	Cached bool `json:"cached"`
+	Age    int  `json:"age"`
+}
+
+// cacheAge returns the age in seconds the result backend reported for a cached result.
+func cacheAge(header http.Header) int {
+	age, err := strconv.Atoi(header.Get("Age"))
+	if err != nil || age < 0 {
+		return 0
+	}
+	return age
+}
+
+// injectCacheMetadata adds a top level _dashpool field to a JSON object, other bodies are left alone.
+func injectCacheMetadata(contentType string, body []byte, age int) ([]byte, bool) {
+	if !strings.Contains(contentType, "json") {
+		return nil, false
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil || object == nil {
+		return nil, false
+	}
+
+	metadata, err := json.Marshal(cacheMetadata{Cached: true, Age: age})
+	if err != nil {
+		return nil, false
+	}
+
+	// Insert the field before the closing brace to keep the original field order
+	trimmed := bytes.TrimRight(body, " \t\r\n")
+	injected := make([]byte, 0, len(trimmed)+len(metadata)+16)
+	injected = append(injected, trimmed[:len(trimmed)-1]...)
+	if len(object) > 0 {
+		injected = append(injected, ',')
+	}
+	injected = append(injected, `"_dashpool":`...)
+	injected = append(injected, metadata...)
+	injected = append(injected, '}')
+
+	return injected, true
+}
@@ -0,0 +1,76 @@
+package dashmiddleware
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Targets of the backend calls, as labeled in the metrics.
+const (
+	backendResult = "result"
+	backendTrack  = "track"
+	backendLayout = "layout"
+	backendPoll   = "poll"
+)
+
+// newBackendClient builds the client shared by all backend calls, so its connection pool is reused.
+func newBackendClient(maxIdleConns int, idleConnTimeout, dialTimeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:       http.ProxyFromEnvironment,
+			DialContext: dialer.DialContext,
+			// All backend calls go to a handful of hosts, the default of 2 per host keeps reconnecting
+			MaxIdleConns:        maxIdleConns,
+			MaxIdleConnsPerHost: maxIdleConns,
+			IdleConnTimeout:     idleConnTimeout,
+		},
+	}
+}
+
+// doBackend sends a request to a backend and measures how long it took.
+func (c *DashMiddleware) doBackend(target string, req *http.Request) (*http.Response, error) {
+	s := c.startChildSpan(spanBackend+target, req.Header)
+	defer c.endSpan(s)
+	s.set("http.url", req.URL.String())
+
+	start := c.now()
+	resp, err := c.client.Do(req)
+	c.metrics.observe("dashmiddleware_backend_duration_seconds", c.now().Sub(start).Seconds(), "target", target)
+	if err != nil {
+		s.set("error", err)
+	} else {
+		s.set("http.status_code", resp.StatusCode)
+	}
+	return resp, err
+}
+
+// retryable reports whether a backend call failed transiently, with a connection error or a 5xx.
+func retryable(ctx context.Context, resp *backendResponse, err error) bool {
+	if err != nil {
+		// The caller gave up, another attempt would fail the same way
+		return ctx.Err() == nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// backoff waits before the retry after the given attempt, doubling the wait with every attempt.
+// It reports false when the context is done before.
+func (c *DashMiddleware) backoff(ctx context.Context, attempt int) bool {
+	if c.retryBackoff <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(c.retryBackoff << attempt)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,31 @@
+package dashmiddleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the address of the client of a request. The forwarding headers can be set
+// by anyone, so they are only honored when TrustForwardedFor says a trusted proxy sets them.
+// X-Forwarded-For then names the client in its leftmost valid entry, X-Real-IP is the fallback.
+func (c *DashMiddleware) clientIP(req *http.Request) string {
+	if c.trustForwardedFor {
+		for _, value := range req.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				if ip := net.ParseIP(strings.TrimSpace(hop)); ip != nil {
+					return ip.String()
+				}
+			}
+		}
+		if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,31 @@
+// Command dashmiddleware runs the middleware as a standalone reverse proxy for local testing.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/dashpool/dashmiddleware"
+)
+
+func main() {
+	config := dashmiddleware.CreateConfig()
+
+	listen := flag.String("listen", ":8000", "address to listen on")
+	upstream := flag.String("upstream", "http://localhost:8050", "URL of the Dash app")
+	flag.StringVar(&config.TrackURL, "trackurl", config.TrackURL, "URL of the track backend")
+	flag.StringVar(&config.ResultURL, "resulturl", config.ResultURL, "URL of the result backend")
+	flag.StringVar(&config.LayoutURL, "layouturl", config.LayoutURL, "URL of the layout backend")
+	flag.Parse()
+
+	handler, err := dashmiddleware.NewStandalone(*upstream, config)
+	if err != nil {
+		log.Fatalf("Failed to create the middleware: %v", err)
+	}
+
+	log.Printf("Proxying %s to %s", *listen, *upstream)
+	if err := http.ListenAndServe(*listen, handler); err != nil {
+		log.Fatalf("Failed to serve: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package dashmiddleware
+
+import (
+	"context"
+	"sync"
+)
+
+// lookupCall a cache lookup in flight, shared by the requests waiting for it.
+type lookupCall struct {
+	done chan struct{}
+	resp *backendResponse
+	err  error
+}
+
+// lookupGroup coalesces concurrent cache lookups of the same key.
+type lookupGroup struct {
+	mu      sync.Mutex
+	calls   map[string]*lookupCall
+	metrics *metrics
+}
+
+func newLookupGroup(metrics *metrics) *lookupGroup {
+	return &lookupGroup{calls: map[string]*lookupCall{}, metrics: metrics}
+}
+
+// do runs lookup unless one for the key is in flight, then it waits for that one instead.
+// The lookup runs on its own, so a client going away does not fail the others waiting for it,
+// and every request stops waiting once its own ctx is done.
+// The shared response must be treated as read-only.
+func (g *lookupGroup) do(ctx context.Context, key string, lookup func() (*backendResponse, error)) (*backendResponse, error) {
+	g.mu.Lock()
+	call, found := g.calls[key]
+	if found {
+		g.mu.Unlock()
+		g.metrics.inc("dashmiddleware_lookups_coalesced_total")
+	} else {
+		call = &lookupCall{done: make(chan struct{})}
+		g.calls[key] = call
+		g.mu.Unlock()
+
+		go func() {
+			call.resp, call.err = lookup()
+
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+	}
+
+	select {
+	case <-call.done:
+		return call.resp, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,33 @@
+package dashmiddleware
+
+import (
+	"strconv"
+)
+
+// Ways to handle a downstream response whose Content-Length does not match its body.
+const (
+	contentLengthNoCache = "nocache"
+	contentLengthCorrect = "correct"
+)
+
+// checkContentLength compares the declared Content-Length of a captured response with its body.
+// It reports whether the result can still be cached, correcting the header when configured to.
+func (c *DashMiddleware) checkContentLength(w *CapturingResponseWriter, url string) bool {
+	declared := w.ResponseWriter.Header().Get("Content-Length")
+	if declared == "" {
+		return true
+	}
+
+	length, err := strconv.Atoi(declared)
+	if err == nil && length == len(w.Body) {
+		return true
+	}
+
+	c.logger.Error("Downstream Content-Length does not match its body", "declared", declared, "written", len(w.Body), "url", url)
+	c.metrics.inc("dashmiddleware_content_length_mismatches_total")
+	if c.onContentLengthMismatch != contentLengthCorrect {
+		return false
+	}
+	w.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(len(w.Body)))
+	return true
+}
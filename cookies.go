@@ -0,0 +1,96 @@
+package dashmiddleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Ways to handle a request with more than MaxCookies cookies.
+const (
+	tooManyCookiesTruncate = "truncate"
+	tooManyCookiesReject   = "reject"
+)
+
+// splitCookies splits a Cookie header line into its cookies, exactly as they were sent.
+// A ';' inside a quoted value does not end the cookie.
+func splitCookies(line string) []string {
+	var cookies []string
+	add := func(cookie string) {
+		if cookie = strings.TrimSpace(cookie); cookie != "" {
+			cookies = append(cookies, cookie)
+		}
+	}
+
+	quoted := false
+	start := 0
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '"':
+			quoted = !quoted
+		case line[i] == ';' && !quoted:
+			add(line[start:i])
+			start = i + 1
+		}
+	}
+	add(line[start:])
+	return cookies
+}
+
+// cookieName the name of a cookie as split by splitCookies.
+func cookieName(cookie string) string {
+	name, _, _ := strings.Cut(cookie, "=")
+	return strings.TrimSpace(name)
+}
+
+// filterCookies removes the auth cookies before the request is forwarded.
+// It returns false when the request has too many cookies and has to be rejected.
+func (c *DashMiddleware) filterCookies(req *http.Request) bool {
+	cookies := req.Header.Values("cookie")
+	req.Header.Del("cookie")
+
+	// restore non auth cookies
+	remaining := c.maxCookies
+	for _, cookieLine := range cookies {
+		cookies := splitCookies(cookieLine)
+		if c.maxCookies > 0 && len(cookies) > remaining {
+			if c.rejectTooManyCookies {
+				return false
+			}
+			cookies = cookies[:remaining]
+		}
+		remaining -= len(cookies)
+
+		var keep []string
+		for _, cookie := range cookies {
+			if !c.hidesAuthCookie(cookie) {
+				keep = append(keep, cookie)
+			}
+		}
+		if len(keep) > 0 {
+			req.Header.Add("cookie", strings.Join(keep, "; "))
+		}
+	}
+
+	return true
+}
+
+// hidesAuthCookie reports whether a cookie is an auth cookie or carries one in a quoted value,
+// which a downstream parser ignoring the quotes would still see.
+func (c *DashMiddleware) hidesAuthCookie(cookie string) bool {
+	for _, part := range strings.Split(cookie, ";") {
+		if c.isAuthCookie(cookieName(part)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthCookie reports whether a cookie belongs to the auth proxy and must not be forwarded.
+func (c *DashMiddleware) isAuthCookie(name string) bool {
+	for _, prefix := range c.stripCookiePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package dashmiddleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// allowedOrigin returns the value for Access-Control-Allow-Origin or an empty string.
+func (c *DashMiddleware) allowedOrigin(origin string) string {
+	for _, allowed := range c.corsAllowOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// servePreflight answers a CORS preflight request without involving any backend.
+func (c *DashMiddleware) servePreflight(responseWriter http.ResponseWriter, req *http.Request) {
+	origin := c.allowedOrigin(req.Header.Get("Origin"))
+	if origin == "" {
+		responseWriter.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	header := responseWriter.Header()
+	setAllowOrigin(header, origin)
+	header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+	header.Set("Access-Control-Max-Age", "600")
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+// allowLayoutOrigin lets the browser read a layout answered by the middleware from an allowed origin,
+// the preflight alone does not make the actual response readable.
+func (c *DashMiddleware) allowLayoutOrigin(responseWriter http.ResponseWriter, req *http.Request) {
+	if len(c.corsAllowOrigins) == 0 {
+		return
+	}
+	if origin := c.allowedOrigin(req.Header.Get("Origin")); origin != "" {
+		setAllowOrigin(responseWriter.Header(), origin)
+	}
+}
+
+// setAllowOrigin allows the origin, a specific one varies the response by Origin.
+func setAllowOrigin(header http.Header, origin string) {
+	header.Set("Access-Control-Allow-Origin", origin)
+	if origin != "*" {
+		header.Add("Vary", "Origin")
+	}
+}
@@ -0,0 +1,23 @@
+package dashmiddleware
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// countingReader counts the bytes read from the request body by the downstream.
+// The downstream may still be reading after a timeout, so the count is atomic.
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.count, int64(n))
+	return n, err
+}
+
+func (r *countingReader) consumed() int64 {
+	return atomic.LoadInt64(&r.count)
+}
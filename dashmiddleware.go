@@ -6,161 +6,1498 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Config the plugin configuration.
 type Config struct {
-	TrackURL     string   `yaml:"trackurl"`
-	LayoutURL    string   `yaml:"layouturl"`
-	ResultURL    string   `yaml:"resulturl"`
-	RecordedURLs []string `yaml:"recordedurls"`
+	TrackURL     string       `yaml:"trackurl"`
+	LayoutURL    string       `yaml:"layouturl"`
+	ResultURL    string       `yaml:"resulturl"`
+	RecordedURLs []string     `yaml:"recordedurls"`
+	TrackRoutes  []TrackRoute `yaml:"trackroutes"`
+
+	RecordedURLMatch string `yaml:"recordedurlmatch"`
+
+	CacheResultNormalizers []Normalizer `yaml:"cacheresultnormalizers"`
+
+	MaxTrackPayloadBytes int    `yaml:"maxtrackpayloadbytes"`
+	OversizedTrack       string `yaml:"oversizedtrack"`
+
+	PrimaryEmailOnly bool     `yaml:"primaryemailonly"`
+	EmailHeaders     []string `yaml:"emailheaders"`
+	SessionHeader    string   `yaml:"sessionheader"`
+	SessionCookie    string   `yaml:"sessioncookie"`
+	TrackAborted     bool     `yaml:"trackaborted"`
+
+	// TrustForwardedFor takes the tracked client address from X-Forwarded-For or X-Real-IP.
+	TrustForwardedFor bool `yaml:"trustforwardedfor"`
+
+	IncludeReferer       bool   `yaml:"includereferer"`
+	RefererRedactPattern string `yaml:"refererredactpattern"`
+
+	FrameParam     string `yaml:"frameparam"`
+	LayoutParam    string `yaml:"layoutparam"`
+	BaseURLPattern string `yaml:"baseurlpattern"`
+
+	TrackEveryN int `yaml:"trackeveryn"`
+
+	FrameCacheTTL   map[string]string `yaml:"framecachettl"`
+	DefaultCacheTTL string            `yaml:"defaultcachettl"`
+
+	TrackNonRecorded      bool    `yaml:"tracknonrecorded"`
+	NonRecordedSampleRate float64 `yaml:"nonrecordedsamplerate"`
+
+	DebugCacheKeyHeader string `yaml:"debugcachekeyheader"`
+
+	CORSAllowOrigins []string `yaml:"corsalloworigins"`
+
+	ResultLookupTimeout string `yaml:"resultlookuptimeout"`
+	DownstreamTimeout   string `yaml:"downstreamtimeout"`
+	RequestTimeout      string `yaml:"requesttimeout"`
+	// Per call bounds of the track and layout backend calls, the RequestTimeout when empty.
+	TrackTimeout  string `yaml:"tracktimeout"`
+	LayoutTimeout string `yaml:"layouttimeout"`
+
+	MaxIdleConns    int    `yaml:"maxidleconns"`
+	IdleConnTimeout string `yaml:"idleconntimeout"`
+	DialTimeout     string `yaml:"dialtimeout"`
+
+	KeyExcludeHeaders []string `yaml:"keyexcludeheaders"`
+	CacheKeyVersion   string   `yaml:"cachekeyversion"`
+	// LookupQueryParams limits the Query of the lookup payload to these params, all of them when empty.
+	LookupQueryParams []string `yaml:"lookupqueryparams"`
+
+	FailOpen bool `yaml:"failopen"`
+
+	MaxBodyBytes    int64 `yaml:"maxbodybytes"`
+	StreamResponses bool  `yaml:"streamresponses"`
+
+	DecompressMinBytes   int64 `yaml:"decompressminbytes"`
+	DecompressMaxBytes   int64 `yaml:"decompressmaxbytes"`
+	MaxDecompressedBytes int64 `yaml:"maxdecompressedbytes"`
+
+	MaxConcurrentLayoutLookups int    `yaml:"maxconcurrentlayoutlookups"`
+	LayoutBackpressureMode     string `yaml:"layoutbackpressuremode"`
+	// LayoutQueueTimeout bounds the wait for a layout lookup slot, defaults to the LayoutTimeout.
+	LayoutQueueTimeout string `yaml:"layoutqueuetimeout"`
+
+	MaxCookies          int      `yaml:"maxcookies"`
+	TooManyCookies      string   `yaml:"toomanycookies"`
+	StripCookiePrefixes []string `yaml:"stripcookieprefixes"`
+
+	EmailHasher     string `yaml:"emailhasher"`
+	EmailHashSecret string `yaml:"emailhashsecret"`
+
+	CaptureMode string `yaml:"capturemode"`
+
+	// TrackRetries are the retries of a track request, -1 (default) uses MaxRetries and 0 turns them off.
+	TrackRetries int `yaml:"trackretries"`
+
+	AsyncTracking      bool   `yaml:"asynctracking"`
+	TrackQueueSize     int    `yaml:"trackqueuesize"`
+	TrackQueueMaxBytes int64  `yaml:"trackqueuemaxbytes"`
+	TrackQueueDrop     string `yaml:"trackqueuedrop"`
+	TrackWorkers       int    `yaml:"trackworkers"`
+
+	MaxRetries   int    `yaml:"maxretries"`
+	RetryBackoff string `yaml:"retrybackoff"`
+
+	MaxConcurrentRecorded  int    `yaml:"maxconcurrentrecorded"`
+	BackpressureMode       string `yaml:"backpressuremode"`
+	BackpressureRetryAfter int    `yaml:"backpressureretryafter"`
+
+	RateLimit       float64            `yaml:"ratelimit"`
+	RateLimitBurst  int                `yaml:"ratelimitburst"`
+	GroupRateLimits map[string]float64 `yaml:"groupratelimits"`
+
+	FormBodyTracking string `yaml:"formbodytracking"`
+
+	CacheIdempotentOnly  bool     `yaml:"cacheidempotentonly"`
+	IdempotentURLs       []string `yaml:"idempotenturls"`
+	MethodOverrideHeader string   `yaml:"methodoverrideheader"`
+	TrustMethodOverride  bool     `yaml:"trustmethodoverride"`
+
+	InjectCacheMetadata bool `yaml:"injectcachemetadata"`
+
+	LongCallbackDedupWindow string `yaml:"longcallbackdedupwindow"`
+
+	// Credentials sent to the backend, empty values fall back to the environment variables named by the *Env fields.
+	BackendToken       string `yaml:"backendtoken"`
+	BackendTokenEnv    string `yaml:"backendtokenenv"`
+	BackendUsername    string `yaml:"backendusername"`
+	BackendPassword    string `yaml:"backendpassword"`
+	BackendPasswordEnv string `yaml:"backendpasswordenv"`
+	EmailHashSecretEnv string `yaml:"emailhashsecretenv"`
+
+	StripDownstreamHeaders []string `yaml:"stripdownstreamheaders"`
+
+	CaptureClientCert bool `yaml:"captureclientcert"`
+
+	OnEmptyLayout  string `yaml:"onemptylayout"`
+	FallbackLayout string `yaml:"fallbacklayout"`
+
+	AllowedRefererHosts      []string `yaml:"allowedrefererhosts"`
+	RejectDisallowedReferers bool     `yaml:"rejectdisallowedreferers"`
+	// RequireReferer rejects recorded requests without a valid http or https Referer with a 400.
+	RequireReferer bool `yaml:"requirereferer"`
+
+	// Groups of X-Auth-Request-Groups that may access the recorded URLs, a denied group always wins.
+	AllowedGroups []string `yaml:"allowedgroups"`
+	DeniedGroups  []string `yaml:"deniedgroups"`
+
+	// LayoutEnabled answers the layout requests from the layout backend, without it they reach the app.
+	LayoutEnabled   bool   `yaml:"layoutenabled"`
+	LayoutURLSuffix string `yaml:"layouturlsuffix"`
+
+	DecompressRequest bool `yaml:"decompressrequest"`
+	DecodeTrackBody   bool `yaml:"decodetrackbody"`
+
+	Features map[string]bool `yaml:"features"`
+
+	CacheValidationSampleRate float64 `yaml:"cachevalidationsamplerate"`
+
+	LocalCacheMaxBytes     int    `yaml:"localcachemaxbytes"`
+	LocalCacheSnapshotPath string `yaml:"localcachesnapshotpath"`
+
+	TraefikHeaders []string `yaml:"traefikheaders"`
+
+	// ShutdownGracePeriod bounds how long Close waits for the background work, unbounded when empty.
+	ShutdownGracePeriod string `yaml:"shutdowngraceperiod"`
+
+	CaptureModeHeader string `yaml:"capturemodeheader"`
+
+	OnResultTimeout string `yaml:"onresulttimeout"`
+
+	OnContentLengthMismatch string `yaml:"oncontentlengthmismatch"`
+
+	LongCallbackHeader string `yaml:"longcallbackheader"`
+
+	// Long callbacks can be polled on PollPath, which asks the PollURL backend for their result.
+	PollPath string `yaml:"pollpath"`
+	PollURL  string `yaml:"pollurl"`
+
+	MetricsEnabled   bool   `yaml:"metricsenabled"`
+	MetricsPath      string `yaml:"metricspath"`
+	MetricsMaxFrames int    `yaml:"metricsmaxframes"`
+
+	HealthEnabled bool   `yaml:"healthenabled"`
+	HealthPath    string `yaml:"healthpath"`
+
+	LogLevel string `yaml:"loglevel"`
+
+	HashAlgorithm string `yaml:"hashalgorithm"`
+
+	PropagateHeaders []string `yaml:"propagateheaders"`
+
+	TracingEnabled bool `yaml:"tracingenabled"`
+	// TracingEndpoint is the OTLP/HTTP traces URL the spans are exported to, they are logged without one.
+	TracingEndpoint string `yaml:"tracingendpoint"`
+
+	// ObserveOnly forwards every request and only tracks it, no cached result, layout or 202 is served.
+	ObserveOnly bool `yaml:"observeonly"`
+}
+
+// What is captured of a recorded response for the track payload.
+const (
+	captureModeFull     = "full"
+	captureModeHeaders  = "headers"
+	captureModeMetadata = "metadata"
+)
+
+// Ways to handle a track payload above MaxTrackPayloadBytes.
+const (
+	oversizedTrackDrop     = "drop"
+	oversizedTrackMetadata = "metadata"
+)
+
+// Normalizer a regular expression replacement applied before a result is cached.
+type Normalizer struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+type compiledNormalizer struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func compileNormalizers(normalizers []Normalizer) ([]compiledNormalizer, error) {
+	compiled := make([]compiledNormalizer, 0, len(normalizers))
+	for _, normalizer := range normalizers {
+		pattern, err := regexp.Compile(normalizer.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid normalizer pattern %q: %w", normalizer.Pattern, err)
+		}
+		compiled = append(compiled, compiledNormalizer{pattern: pattern, replacement: normalizer.Replacement})
+	}
+	return compiled, nil
+}
+
+func normalize(normalizers []compiledNormalizer, value string) string {
+	for _, normalizer := range normalizers {
+		value = normalizer.pattern.ReplaceAllString(value, normalizer.replacement)
+	}
+	return value
+}
+
+// TrackRoute sends the track events of matching requests to a dedicated backend.
+// All conditions that are set have to match, routes are evaluated in order.
+type TrackRoute struct {
+	LongCallback bool   `yaml:"longcallback"`
+	FramePrefix  string `yaml:"frameprefix"`
+	TrackURL     string `yaml:"trackurl"`
+}
+
+func (r TrackRoute) matches(isLongCallback bool, frame string) bool {
+	if r.LongCallback && !isLongCallback {
+		return false
+	}
+	if r.FramePrefix != "" && !strings.HasPrefix(frame, r.FramePrefix) {
+		return false
+	}
+	return true
+}
+
+// CreateConfig creates the default plugin configuration.
+func CreateConfig() *Config {
+	return &Config{
+		TrackURL:     "http://backend.dashpool-system:8080/track",
+		ResultURL:    "http://backend.dashpool-system:8080/result",
+		LayoutURL:    "http://backend.dashpool-system:8080/getlayout",
+		RecordedURLs: []string{"/_dash-update-component", "/_dash-layout"},
+		EmailHeaders: []string{defaultEmailHeader},
+
+		RecordedURLMatch: recordedURLMatchSuffix,
+
+		OversizedTrack:      oversizedTrackDrop,
+		MaxCookies:          50,
+		TooManyCookies:      tooManyCookiesTruncate,
+		StripCookiePrefixes: []string{"_oauth2_proxy"},
+		CaptureMode:         captureModeFull,
+
+		BackpressureMode:       backpressureWait,
+		BackpressureRetryAfter: 1,
+
+		FormBodyTracking: formBodyRaw,
+
+		RequestTimeout: "10s",
+
+		MaxIdleConns:    100,
+		IdleConnTimeout: "90s",
+		DialTimeout:     "5s",
+
+		TrackRetries: -1,
+		RetryBackoff: "100ms",
+
+		TrackQueueSize: 1000,
+		TrackQueueDrop: trackQueueDropNewest,
+		TrackWorkers:   1,
+
+		FailOpen: true,
+
+		LayoutEnabled: true,
+
+		NonRecordedSampleRate: 1,
+
+		MaxDecompressedBytes: 10 << 20,
+
+		LayoutBackpressureMode: backpressureWait,
+
+		OnEmptyLayout: emptyLayoutPassthrough,
+
+		LayoutURLSuffix: defaultLayoutURLSuffix,
+
+		TraefikHeaders: append([]string(nil), defaultTraefikHeaders...),
+
+		OnResultTimeout: resultTimeoutMiss,
+
+		OnContentLengthMismatch: contentLengthNoCache,
+
+		LongCallbackHeader: defaultLongCallbackHeader,
+
+		MetricsPath:      defaultMetricsPath,
+		MetricsMaxFrames: 100,
+
+		HealthPath: defaultHealthPath,
+
+		LogLevel: logLevelInfo,
+
+		HashAlgorithm: hashSHA256,
+
+		PropagateHeaders: append([]string(nil), defaultPropagateHeaders...),
+	}
+}
+
+// DashMiddleware a DashMiddleware plugin.
+type DashMiddleware struct {
+	next         http.Handler
+	trackURL     string
+	layoutURL    string
+	resultURL    string
+	name         string
+	recordedURLs []string
+	trackRoutes  []TrackRoute
+
+	recordedURLMatch string
+	// recordedURLPatterns are the compiled RecordedURLs in the regex match mode.
+	recordedURLPatterns []*regexp.Regexp
+
+	resultNormalizers []compiledNormalizer
+
+	maxTrackPayloadBytes int
+	oversizedTrack       string
+
+	primaryEmailOnly bool
+	trackAborted     bool
+
+	includeReferer       bool
+	refererRedactPattern *regexp.Regexp
+
+	frameRegex   *regexp.Regexp
+	layoutRegex  *regexp.Regexp
+	baseURLRegex *regexp.Regexp
+
+	trackEveryN int64
+	// recordedCount counts the recorded requests, accessed atomically.
+	recordedCount int64
+
+	debugCacheKeyHeader string
+
+	corsAllowOrigins []string
+
+	emailHasher  func(string) string
+	emailHeaders []string
+
+	sessionHeader string
+	sessionCookie string
+
+	trustForwardedFor bool
+
+	resultLookupTimeout time.Duration
+	downstreamTimeout   time.Duration
+	requestTimeout      time.Duration
+	trackTimeout        time.Duration
+	layoutTimeout       time.Duration
+
+	// client is shared by all backend calls.
+	client *http.Client
+
+	maxCookies           int
+	rejectTooManyCookies bool
+	stripCookiePrefixes  []string
+
+	malformedExpiresOnce sync.Once
+
+	captureMode string
+
+	trackRetries int
+
+	// trackQueue holds the track requests sent asynchronously, nil when tracking is synchronous.
+	trackQueue *trackQueue
+	// trackWorkers the number of workers sending the queued track requests, done once they stopped.
+	trackWorkers     int
+	trackWorkersDone sync.WaitGroup
+
+	maxRetries   int
+	retryBackoff time.Duration
+
+	// recordedSlots bounds the concurrent recorded requests, nil when unbounded.
+	recordedSlots          chan struct{}
+	backpressureMode       string
+	backpressureRetryAfter int
+
+	rateLimiter *rateLimiter
+
+	formBodyTracking string
+
+	cacheIdempotentOnly bool
+	idempotentURLs      []string
+
+	methodOverrideHeader string
+	trustMethodOverride  bool
+
+	injectCacheMetadata bool
+
+	longCallbackJobs *pendingJobs
+
+	backendToken    string
+	backendUsername string
+	backendPassword string
+
+	stripDownstreamHeaders []string
+
+	captureClientCert bool
+
+	onEmptyLayout  string
+	fallbackLayout []byte
+
+	allowedRefererHosts      []string
+	rejectDisallowedReferers bool
+	requireReferer           bool
+
+	allowedGroups []string
+	deniedGroups  []string
+
+	layoutEnabled   bool
+	layoutURLSuffix string
+
+	decompressRequest bool
+	decodeTrackBody   bool
+
+	features    map[string]bool
+	lookupGroup *lookupGroup
+
+	cacheValidationSampleRate float64
+
+	frameCacheTTLs  map[string]time.Duration
+	defaultCacheTTL time.Duration
+
+	trackNonRecorded      bool
+	nonRecordedSampleRate float64
+
+	// localCache keeps cached results in memory, nil when disabled.
+	localCache             *localCache
+	localCacheSnapshotPath string
+
+	traefikHeaders []string
+
+	captureModeHeader string
+
+	onResultTimeout string
+
+	onContentLengthMismatch string
+
+	longCallbackHeader string
+
+	pollPath string
+	pollURL  string
+
+	metricsEnabled bool
+	metricsPath    string
+
+	healthEnabled bool
+	healthPath    string
+	frameLabels   *labelLimiter
+
+	vary              *varyHeaders
+	keyExcludeHeaders map[string]bool
+	cacheKeyVersion   string
+	lookupQueryParams []string
+
+	failOpen bool
+
+	maxBodyBytes    int64
+	streamResponses bool
+
+	decompressMinBytes   int64
+	decompressMaxBytes   int64
+	maxDecompressedBytes int64
+
+	// layoutSlots bounds the concurrent layout lookups, nil when unbounded.
+	layoutSlots            chan struct{}
+	layoutBackpressureMode string
+	layoutQueueTimeout     time.Duration
+
+	metrics *metrics
+
+	// lifecycle is the context given to New, its cancellation drains the background work.
+	lifecycle context.Context
+	// stopping is done once the middleware is closed, background waits end with it.
+	stopping context.Context
+	stop     context.CancelFunc
+	// background tracks the work still running after the response was served.
+	background   sync.WaitGroup
+	backgroundMu sync.Mutex
+	draining     bool
+	drained      chan struct{}
+	// closeOnce makes Close safe to call repeatedly, closeErr is its result.
+	closeOnce           sync.Once
+	closeErr            error
+	shutdownGracePeriod time.Duration
+
+	// now is the clock used to measure durations, replaceable in tests.
+	now func() time.Time
+
+	logger Logger
+
+	// resultHasher hashes the tracked results, nil when they are not hashed.
+	resultHasher func() hash.Hash
+
+	propagateHeaders []string
+
+	tracingEnabled  bool
+	tracingEndpoint string
+	// pendingSpans are the finished spans waiting to be exported, spansFull tells the exporter a batch is full.
+	spansMu      sync.Mutex
+	pendingSpans []otlpSpan
+	spansFull    chan struct{}
+
+	observeOnly bool
+}
+
+// New creates a new DashMiddleware plugin.
+func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	// Secrets can be kept out of the Traefik configuration
+	config.BackendToken = fromEnv(config.BackendToken, config.BackendTokenEnv)
+	config.BackendPassword = fromEnv(config.BackendPassword, config.BackendPasswordEnv)
+	config.EmailHashSecret = fromEnv(config.EmailHashSecret, config.EmailHashSecretEnv)
+
+	logger, err := newStdLogger(config.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	resultHasher, err := newResultHasher(config.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	resultNormalizers, err := compileNormalizers(config.CacheResultNormalizers)
+	if err != nil {
+		return nil, err
+	}
+
+	var recordedURLPatterns []*regexp.Regexp
+	switch config.RecordedURLMatch {
+	case recordedURLMatchSuffix, recordedURLMatchExact:
+	case "":
+		config.RecordedURLMatch = recordedURLMatchSuffix
+	case recordedURLMatchRegex:
+		for _, recordedURL := range config.RecordedURLs {
+			pattern, err := regexp.Compile(recordedURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid recordedurls pattern %q: %w", recordedURL, err)
+			}
+			recordedURLPatterns = append(recordedURLPatterns, pattern)
+		}
+	default:
+		return nil, fmt.Errorf("invalid recordedurlmatch %q, expected %q, %q or %q", config.RecordedURLMatch, recordedURLMatchSuffix, recordedURLMatchExact, recordedURLMatchRegex)
+	}
+
+	var refererRedactPattern *regexp.Regexp
+	if config.RefererRedactPattern != "" {
+		refererRedactPattern, err = regexp.Compile(config.RefererRedactPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid refererredactpattern %q: %w", config.RefererRedactPattern, err)
+		}
+	}
+
+	frameRegex, layoutRegex := defaultFrameRegex, defaultLayoutRegex
+	if config.FrameParam != "" {
+		frameRegex = refererParamRegex(config.FrameParam)
+	}
+	if config.LayoutParam != "" {
+		layoutRegex = refererParamRegex(config.LayoutParam)
+	}
+	baseURLRegex := defaultBaseURLRegex
+	if config.BaseURLPattern != "" {
+		baseURLRegex, err = regexp.Compile(config.BaseURLPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid baseurlpattern %q: %w", config.BaseURLPattern, err)
+		}
+		if baseURLRegex.NumSubexp() < 1 {
+			return nil, fmt.Errorf("invalid baseurlpattern %q, expected a capture group for the base path", config.BaseURLPattern)
+		}
+	}
+
+	if len(config.EmailHeaders) == 0 {
+		config.EmailHeaders = []string{defaultEmailHeader}
+	}
+
+	if config.LongCallbackHeader == "" {
+		config.LongCallbackHeader = defaultLongCallbackHeader
+	}
+
+	emailHasher, err := newEmailHasher(config.EmailHasher, config.EmailHashSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	resultLookupTimeout, err := parseDuration("resultlookuptimeout", config.ResultLookupTimeout)
+	if err != nil {
+		return nil, err
+	}
+	downstreamTimeout, err := parseDuration("downstreamtimeout", config.DownstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	requestTimeout, err := parseDuration("requesttimeout", config.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	shutdownGracePeriod, err := parseDuration("shutdowngraceperiod", config.ShutdownGracePeriod)
+	if err != nil {
+		return nil, err
+	}
+	trackTimeout, err := parseDuration("tracktimeout", config.TrackTimeout)
+	if err != nil {
+		return nil, err
+	}
+	layoutTimeout, err := parseDuration("layouttimeout", config.LayoutTimeout)
+	if err != nil {
+		return nil, err
+	}
+	layoutQueueTimeout, err := parseDuration("layoutqueuetimeout", config.LayoutQueueTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if layoutQueueTimeout == 0 {
+		layoutQueueTimeout = layoutTimeout
+	}
+	idleConnTimeout, err := parseDuration("idleconntimeout", config.IdleConnTimeout)
+	if err != nil {
+		return nil, err
+	}
+	frameCacheTTLs, err := parseFrameCacheTTLs(config.FrameCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultCacheTTL, err := parseDuration("defaultcachettl", config.DefaultCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	retryBackoff, err := parseDuration("retrybackoff", config.RetryBackoff)
+	if err != nil {
+		return nil, err
+	}
+
+	dialTimeout, err := parseDuration("dialtimeout", config.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	longCallbackDedupWindow, err := parseDuration("longcallbackdedupwindow", config.LongCallbackDedupWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.TooManyCookies {
+	case "", tooManyCookiesTruncate, tooManyCookiesReject:
+	default:
+		return nil, fmt.Errorf("invalid toomanycookies %q, expected %q or %q", config.TooManyCookies, tooManyCookiesTruncate, tooManyCookiesReject)
+	}
+
+	switch config.CaptureMode {
+	case "":
+		config.CaptureMode = captureModeFull
+	case captureModeFull, captureModeHeaders, captureModeMetadata:
+	default:
+		return nil, fmt.Errorf("invalid capturemode %q, expected %q, %q or %q", config.CaptureMode, captureModeFull, captureModeHeaders, captureModeMetadata)
+	}
+
+	switch config.BackpressureMode {
+	case "":
+		config.BackpressureMode = backpressureWait
+	case backpressureWait, backpressureReject:
+	default:
+		return nil, fmt.Errorf("invalid backpressuremode %q, expected %q or %q", config.BackpressureMode, backpressureWait, backpressureReject)
+	}
+
+	switch config.LayoutBackpressureMode {
+	case "":
+		config.LayoutBackpressureMode = backpressureWait
+	case backpressureWait, backpressureReject:
+	default:
+		return nil, fmt.Errorf("invalid layoutbackpressuremode %q, expected %q or %q", config.LayoutBackpressureMode, backpressureWait, backpressureReject)
+	}
+
+	var layoutSlots chan struct{}
+	if config.MaxConcurrentLayoutLookups > 0 {
+		layoutSlots = make(chan struct{}, config.MaxConcurrentLayoutLookups)
+	}
+
+	var recordedSlots chan struct{}
+	if config.MaxConcurrentRecorded > 0 {
+		recordedSlots = make(chan struct{}, config.MaxConcurrentRecorded)
+	}
+
+	switch config.FormBodyTracking {
+	case "":
+		config.FormBodyTracking = formBodyRaw
+	case formBodyRaw, formBodyMetadata, formBodySkip:
+	default:
+		return nil, fmt.Errorf("invalid formbodytracking %q, expected %q, %q or %q", config.FormBodyTracking, formBodyRaw, formBodyMetadata, formBodySkip)
+	}
+
+	checkFeatures(logger, config.Features)
+
+	if config.MetricsPath == "" {
+		config.MetricsPath = defaultMetricsPath
+	}
+
+	if config.HealthPath == "" {
+		config.HealthPath = defaultHealthPath
+	}
+
+	if config.PollPath != "" && config.PollURL == "" {
+		return nil, errors.New("pollpath requires a pollurl")
+	}
+
+	// A typo in a backend URL would only show up as failing backend calls
+	if err := validateBackendURLs(config); err != nil {
+		return nil, err
+	}
+
+	switch config.OnResultTimeout {
+	case "":
+		config.OnResultTimeout = resultTimeoutMiss
+	case resultTimeoutFailClosed, resultTimeoutMiss:
+	default:
+		return nil, fmt.Errorf("invalid onresulttimeout %q, expected %q or %q", config.OnResultTimeout, resultTimeoutFailClosed, resultTimeoutMiss)
+	}
+
+	switch config.OnContentLengthMismatch {
+	case contentLengthNoCache, contentLengthCorrect:
+	case "":
+		config.OnContentLengthMismatch = contentLengthNoCache
+	default:
+		return nil, fmt.Errorf("invalid oncontentlengthmismatch %q, expected %q or %q", config.OnContentLengthMismatch, contentLengthNoCache, contentLengthCorrect)
+	}
+
+	if config.CacheValidationSampleRate < 0 || config.CacheValidationSampleRate > 1 {
+		return nil, fmt.Errorf("invalid cachevalidationsamplerate %v, expected a value between 0 and 1", config.CacheValidationSampleRate)
+	}
+
+	switch config.TrackQueueDrop {
+	case trackQueueDropNewest, trackQueueDropOldest:
+	case "":
+		config.TrackQueueDrop = trackQueueDropNewest
+	default:
+		return nil, fmt.Errorf("invalid trackqueuedrop %q, expected %q or %q", config.TrackQueueDrop, trackQueueDropNewest, trackQueueDropOldest)
+	}
+
+	if config.TrackWorkers <= 0 {
+		config.TrackWorkers = 1
+	}
+
+	if config.MaxRetries < 0 {
+		return nil, fmt.Errorf("invalid maxretries %d, expected 0 or more", config.MaxRetries)
+	}
+	switch {
+	case config.TrackRetries == -1:
+		config.TrackRetries = config.MaxRetries
+	case config.TrackRetries < 0:
+		return nil, fmt.Errorf("invalid trackretries %d, expected 0 or more, or -1 for the maxretries", config.TrackRetries)
+	}
+
+	var trackQueue *trackQueue
+	if config.AsyncTracking {
+		trackQueue = newTrackQueue(config.TrackQueueSize, config.TrackQueueMaxBytes, config.TrackQueueDrop == trackQueueDropOldest)
+	}
+
+	if config.NonRecordedSampleRate < 0 || config.NonRecordedSampleRate > 1 {
+		return nil, fmt.Errorf("invalid nonrecordedsamplerate %v, expected a value between 0 and 1", config.NonRecordedSampleRate)
+	}
+
+	if config.LayoutURLSuffix == "" {
+		config.LayoutURLSuffix = defaultLayoutURLSuffix
+	}
+
+	switch config.OnEmptyLayout {
+	case "":
+		config.OnEmptyLayout = emptyLayoutPassthrough
+	case emptyLayoutPassthrough, emptyLayoutError:
+	case emptyLayoutFallback:
+		if !json.Valid([]byte(config.FallbackLayout)) {
+			return nil, errors.New("onemptylayout fallback requires a valid JSON fallbacklayout")
+		}
+	default:
+		return nil, fmt.Errorf("invalid onemptylayout %q, expected %q, %q or %q", config.OnEmptyLayout, emptyLayoutPassthrough, emptyLayoutFallback, emptyLayoutError)
+	}
+
+	switch config.OversizedTrack {
+	case "":
+		config.OversizedTrack = oversizedTrackDrop
+	case oversizedTrackDrop, oversizedTrackMetadata:
+	default:
+		return nil, fmt.Errorf("invalid oversizedtrack %q, expected %q or %q", config.OversizedTrack, oversizedTrackDrop, oversizedTrackMetadata)
+	}
+
+	var localCache *localCache
+	if config.LocalCacheMaxBytes > 0 {
+		localCache = newLocalCache(config.LocalCacheMaxBytes)
+	}
+	if config.LocalCacheSnapshotPath != "" {
+		if localCache == nil {
+			return nil, errors.New("localcachesnapshotpath requires localcachemaxbytes")
+		}
+		if err := loadLocalCacheSnapshot(config.LocalCacheSnapshotPath, localCache, time.Now(), logger); err != nil {
+			return nil, err
+		}
+	}
+
+	keyExcludeHeaders := make(map[string]bool, len(config.KeyExcludeHeaders))
+	for _, name := range config.KeyExcludeHeaders {
+		keyExcludeHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+
+	registry := newMetrics()
+	stopping, stop := context.WithCancel(ctx)
+
+	c := &DashMiddleware{
+		trackURL:     config.TrackURL,
+		layoutURL:    config.LayoutURL,
+		resultURL:    config.ResultURL,
+		next:         next,
+		name:         name,
+		recordedURLs: config.RecordedURLs,
+		trackRoutes:  config.TrackRoutes,
+
+		recordedURLMatch:    config.RecordedURLMatch,
+		recordedURLPatterns: recordedURLPatterns,
+
+		resultNormalizers: resultNormalizers,
+
+		maxTrackPayloadBytes: config.MaxTrackPayloadBytes,
+		oversizedTrack:       config.OversizedTrack,
+
+		primaryEmailOnly: config.PrimaryEmailOnly,
+		trackAborted:     config.TrackAborted,
+
+		includeReferer:       config.IncludeReferer,
+		refererRedactPattern: refererRedactPattern,
+
+		frameRegex:   frameRegex,
+		layoutRegex:  layoutRegex,
+		baseURLRegex: baseURLRegex,
+
+		trackEveryN: int64(config.TrackEveryN),
+
+		debugCacheKeyHeader: config.DebugCacheKeyHeader,
+
+		corsAllowOrigins: config.CORSAllowOrigins,
+
+		emailHasher:  emailHasher,
+		emailHeaders: config.EmailHeaders,
+
+		sessionHeader: config.SessionHeader,
+		sessionCookie: config.SessionCookie,
+
+		trustForwardedFor: config.TrustForwardedFor,
+
+		resultLookupTimeout: resultLookupTimeout,
+		downstreamTimeout:   downstreamTimeout,
+		requestTimeout:      requestTimeout,
+		trackTimeout:        trackTimeout,
+		layoutTimeout:       layoutTimeout,
+
+		client: newBackendClient(config.MaxIdleConns, idleConnTimeout, dialTimeout),
+
+		maxCookies:           config.MaxCookies,
+		rejectTooManyCookies: config.TooManyCookies == tooManyCookiesReject,
+		stripCookiePrefixes:  config.StripCookiePrefixes,
+
+		captureMode: config.CaptureMode,
+
+		trackRetries: config.TrackRetries,
+		trackQueue:   trackQueue,
+		trackWorkers: config.TrackWorkers,
+
+		maxRetries:   config.MaxRetries,
+		retryBackoff: retryBackoff,
+
+		recordedSlots:          recordedSlots,
+		backpressureMode:       config.BackpressureMode,
+		backpressureRetryAfter: config.BackpressureRetryAfter,
+
+		rateLimiter: newRateLimiter(config.RateLimit, config.GroupRateLimits, config.RateLimitBurst),
+
+		formBodyTracking: config.FormBodyTracking,
+
+		cacheIdempotentOnly: config.CacheIdempotentOnly,
+		idempotentURLs:      config.IdempotentURLs,
+
+		methodOverrideHeader: config.MethodOverrideHeader,
+		trustMethodOverride:  config.TrustMethodOverride,
+
+		injectCacheMetadata: config.InjectCacheMetadata,
+
+		longCallbackJobs: newPendingJobs(longCallbackDedupWindow),
+
+		backendToken:    config.BackendToken,
+		backendUsername: config.BackendUsername,
+		backendPassword: config.BackendPassword,
+
+		stripDownstreamHeaders: config.StripDownstreamHeaders,
+
+		captureClientCert: config.CaptureClientCert,
+
+		onEmptyLayout:  config.OnEmptyLayout,
+		fallbackLayout: []byte(config.FallbackLayout),
+
+		allowedRefererHosts:      config.AllowedRefererHosts,
+		rejectDisallowedReferers: config.RejectDisallowedReferers,
+		requireReferer:           config.RequireReferer,
+
+		allowedGroups: config.AllowedGroups,
+		deniedGroups:  config.DeniedGroups,
+
+		layoutEnabled:   config.LayoutEnabled,
+		layoutURLSuffix: config.LayoutURLSuffix,
+
+		decompressRequest: config.DecompressRequest,
+		decodeTrackBody:   config.DecodeTrackBody,
+
+		features:    config.Features,
+		lookupGroup: newLookupGroup(registry),
+
+		cacheValidationSampleRate: config.CacheValidationSampleRate,
+
+		frameCacheTTLs:  frameCacheTTLs,
+		defaultCacheTTL: defaultCacheTTL,
+
+		trackNonRecorded:      config.TrackNonRecorded,
+		nonRecordedSampleRate: config.NonRecordedSampleRate,
+
+		localCache:             localCache,
+		localCacheSnapshotPath: config.LocalCacheSnapshotPath,
+
+		traefikHeaders: config.TraefikHeaders,
+
+		captureModeHeader: config.CaptureModeHeader,
+
+		onResultTimeout: config.OnResultTimeout,
+
+		onContentLengthMismatch: config.OnContentLengthMismatch,
+
+		longCallbackHeader: config.LongCallbackHeader,
+
+		pollPath: config.PollPath,
+		pollURL:  config.PollURL,
+
+		metricsEnabled: config.MetricsEnabled,
+		metricsPath:    config.MetricsPath,
+
+		healthEnabled: config.HealthEnabled,
+		healthPath:    config.HealthPath,
+		frameLabels:   newLabelLimiter(config.MetricsMaxFrames),
+
+		vary:              newVaryHeaders(),
+		keyExcludeHeaders: keyExcludeHeaders,
+		cacheKeyVersion:   config.CacheKeyVersion,
+		lookupQueryParams: config.LookupQueryParams,
+
+		failOpen: config.FailOpen,
+
+		maxBodyBytes:    config.MaxBodyBytes,
+		streamResponses: config.StreamResponses,
+
+		decompressMinBytes:   config.DecompressMinBytes,
+		decompressMaxBytes:   config.DecompressMaxBytes,
+		maxDecompressedBytes: config.MaxDecompressedBytes,
+
+		layoutSlots:            layoutSlots,
+		layoutBackpressureMode: config.LayoutBackpressureMode,
+		layoutQueueTimeout:     layoutQueueTimeout,
+
+		metrics: registry,
+		now:     time.Now,
+
+		lifecycle:           ctx,
+		stopping:            stopping,
+		stop:                stop,
+		drained:             make(chan struct{}),
+		shutdownGracePeriod: shutdownGracePeriod,
+
+		logger: logger,
+
+		resultHasher: resultHasher,
+
+		propagateHeaders: config.PropagateHeaders,
+
+		tracingEnabled:  config.TracingEnabled,
+		tracingEndpoint: config.TracingEndpoint,
+		spansFull:       make(chan struct{}, 1),
+
+		observeOnly: config.ObserveOnly,
+	}
+	c.startLifecycle()
+	if c.trackQueue != nil {
+		for i := 0; i < c.trackWorkers; i++ {
+			c.trackWorkersDone.Add(1)
+			c.goBackground(c.runTrackQueue)
+		}
+	}
+	if c.tracingEndpoint != "" {
+		c.goBackground(c.runSpanExporter)
+	}
+
+	return c, nil
+}
+
+// requestCaptureMode returns the capture mode of a request, a trusted header can override the configured one.
+// The header is removed, the app does not need to see it.
+func (c *DashMiddleware) requestCaptureMode(header http.Header) string {
+	if c.captureModeHeader == "" {
+		return c.captureMode
+	}
+
+	requested := header.Get(c.captureModeHeader)
+	header.Del(c.captureModeHeader)
+	switch requested {
+	case captureModeFull, captureModeHeaders, captureModeMetadata:
+		return requested
+	default:
+		return c.captureMode
+	}
+}
+
+// fromEnv returns the value or, when it is empty, the value of the named environment variable.
+func fromEnv(value, name string) string {
+	if value != "" || name == "" {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+// authorize adds the configured backend credentials to a backend request.
+func (c *DashMiddleware) authorize(req *http.Request) {
+	switch {
+	case c.backendToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.backendToken)
+	case c.backendUsername != "" || c.backendPassword != "":
+		req.SetBasicAuth(c.backendUsername, c.backendPassword)
+	}
+}
+
+// preservedHeaders are needed by Dash for content negotiation and are never stripped.
+var preservedHeaders = map[string]bool{
+	"Accept":          true,
+	"Accept-Language": true,
+	"Content-Type":    true,
+}
+
+// stripHeaders removes the configured headers, a trailing * matches a prefix.
+func (c *DashMiddleware) stripHeaders(header http.Header) {
+	for _, name := range c.stripDownstreamHeaders {
+		if !strings.HasSuffix(name, "*") {
+			if !preservedHeaders[http.CanonicalHeaderKey(name)] {
+				header.Del(name)
+			}
+			continue
+		}
+
+		prefix := http.CanonicalHeaderKey(strings.TrimSuffix(name, "*"))
+		for key := range header {
+			if strings.HasPrefix(http.CanonicalHeaderKey(key), prefix) && !preservedHeaders[http.CanonicalHeaderKey(key)] {
+				delete(header, key)
+			}
+		}
+	}
+}
+
+// parseDuration parses an optional duration config field, empty means no duration.
+func parseDuration(field, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", field, value, err)
+	}
+	return duration, nil
 }
 
-// CreateConfig creates the default plugin configuration.
-func CreateConfig() *Config {
-	return &Config{
-		TrackURL:     "http://backend.dashpool-system:8080/track",
-		ResultURL:    "http://backend.dashpool-system:8080/result",
-		LayoutURL:    "http://backend.dashpool-system:8080/getlayout",
-		RecordedURLs: []string{"/_dash-update-component", "/_dash-layout"},
+// validateBackendURLs checks the backend URLs of the enabled features, an empty one is only
+// allowed for a disabled feature.
+func validateBackendURLs(config *Config) error {
+	if err := parseBackendURL("trackurl", config.TrackURL); err != nil {
+		return err
+	}
+	for i, route := range config.TrackRoutes {
+		if err := parseBackendURL(fmt.Sprintf("trackroutes[%d].trackurl", i), route.TrackURL); err != nil {
+			return err
+		}
+	}
+
+	if config.ResultURL != "" || !config.ObserveOnly {
+		if err := parseBackendURL("resulturl", config.ResultURL); err != nil {
+			return err
+		}
+	}
+	if config.LayoutURL != "" || config.LayoutEnabled {
+		if err := parseBackendURL("layouturl", config.LayoutURL); err != nil {
+			return fmt.Errorf("%w (set layoutenabled to false to not use a layout backend)", err)
+		}
+	}
+	if config.PollURL != "" {
+		if err := parseBackendURL("pollurl", config.PollURL); err != nil {
+			return err
+		}
+	}
+	if config.TracingEndpoint != "" {
+		return parseBackendURL("tracingendpoint", config.TracingEndpoint)
 	}
+	return nil
 }
 
-// DashMiddleware a DashMiddleware plugin.
-type DashMiddleware struct {
-	next         http.Handler
-	trackURL     string
-	layoutURL    string
-	resultURL    string
-	name         string
-	recordedURLs []string
+// parseBackendURL checks that a backend URL is an absolute http or https URL.
+func parseBackendURL(field, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", field)
+	}
+
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", field, value, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("invalid %s %q, expected an %q or %q URL", field, value, "http", "https")
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("invalid %s %q: the host is missing", field, value)
+	}
+	return nil
 }
 
-// New creates a new DashMiddleware plugin.
-func New(_ context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	return &DashMiddleware{
-		trackURL:     config.TrackURL,
-		layoutURL:    config.LayoutURL,
-		resultURL:    config.ResultURL,
-		next:         next,
-		name:         name,
-		recordedURLs: config.RecordedURLs,
-	}, nil
+// Ways RecordedURLs are matched against a request.
+const (
+	// recordedURLMatchSuffix matches the end of the URL.
+	recordedURLMatchSuffix = "suffix"
+	// recordedURLMatchExact matches the whole path.
+	recordedURLMatchExact = "exact"
+	// recordedURLMatchRegex matches the path against the entries as regular expressions.
+	recordedURLMatchRegex = "regex"
+)
+
+// matchRecordedURL returns the RecordedURLs entry matching the URL, or its path depending on the match mode.
+func (c *DashMiddleware) matchRecordedURL(url, path string) (string, bool) {
+	for i, recordedURL := range c.recordedURLs {
+		var matched bool
+		switch c.recordedURLMatch {
+		case recordedURLMatchExact:
+			matched = path == recordedURL
+		case recordedURLMatchRegex:
+			matched = c.recordedURLPatterns[i].MatchString(path)
+		default:
+			matched = strings.HasSuffix(url, recordedURL)
+		}
+		if matched {
+			return recordedURL, true
+		}
+	}
+	return "", false
+}
+
+// isCacheable reports whether the result of a request may be served from and offered to the cache.
+// Only safe methods are idempotent, other requests have to be listed in IdempotentURLs.
+func (c *DashMiddleware) isCacheable(method, url string) bool {
+	if !c.cacheIdempotentOnly || method == http.MethodGet || method == http.MethodHead {
+		return true
+	}
+	for _, idempotentURL := range c.idempotentURLs {
+		if strings.HasSuffix(url, idempotentURL) {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveMethod returns the method for caching decisions, a trusted override header replaces the one of a POST.
+// The request is forwarded with its own method.
+func (c *DashMiddleware) effectiveMethod(req *http.Request) string {
+	if !c.trustMethodOverride || c.methodOverrideHeader == "" || req.Method != http.MethodPost {
+		return req.Method
+	}
+	if override := req.Header.Get(c.methodOverrideHeader); override != "" {
+		return strings.ToUpper(strings.TrimSpace(override))
+	}
+	return req.Method
+}
+
+// trackURLFor returns the track backend of the first matching route or the default one.
+func (c *DashMiddleware) trackURLFor(isLongCallback bool, frame string) string {
+	for _, route := range c.trackRoutes {
+		if route.matches(isLongCallback, frame) {
+			return route.TrackURL
+		}
+	}
+	return c.trackURL
+}
+
+// primaryEmail reduces repeated or comma joined email headers to the first address.
+func primaryEmail(values []string) []string {
+	for _, value := range values {
+		for _, address := range strings.Split(value, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				return []string{address}
+			}
+		}
+	}
+	return []string{}
+}
+
+// validReferer reports whether the referer is an absolute http or https URL.
+func validReferer(referer string) bool {
+	parsed, err := url.Parse(referer)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
 }
 
-// LayoutRequestData needed to get a layout from the backend server.
-type LayoutRequestData struct {
-	Email  []string `json:"email"`
-	Layout string   `json:"layout"`
-	Frame  string   `json:"frame"`
+// refererAllowed reports whether the referer host is allowed to embed the apps.
+func (c *DashMiddleware) refererAllowed(referer string) bool {
+	if len(c.allowedRefererHosts) == 0 {
+		return true
+	}
+
+	parsed, err := url.Parse(referer)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+
+	for _, host := range c.allowedRefererHosts {
+		if strings.EqualFold(host, parsed.Host) || strings.EqualFold(host, parsed.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactReferer replaces the values of the query params matching the redact pattern.
+func (c *DashMiddleware) redactReferer(referer string) string {
+	if c.refererRedactPattern == nil || referer == "" {
+		return referer
+	}
+
+	parsed, err := url.Parse(referer)
+	if err != nil {
+		// Without a parsed query there is no way to tell what needs to be redacted
+		return ""
+	}
+
+	query := parsed.Query()
+	for param := range query {
+		if c.refererRedactPattern.MatchString(param) {
+			query.Set(param, "REDACTED")
+		}
+	}
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String()
 }
 
-// Define the regular expressions globally.
+// Define the default regular expressions globally.
 var (
-	splitRegexp  = regexp.MustCompile(` *([^=;]+?) *=[^;]+`)
-	frameRegex   = regexp.MustCompile(`(?:.*[?&]frame=)([^&]+)`)
-	layoutRegex  = regexp.MustCompile(`(?:.*[?&]layout=)([^&]+)`)
-	baseURLRegex = regexp.MustCompile(`https:\/\/[^\/]+(.+?)\/\?`)
+	defaultFrameRegex   = refererParamRegex("frame")
+	defaultLayoutRegex  = refererParamRegex("layout")
+	defaultBaseURLRegex = regexp.MustCompile(`https?:\/\/[^\/]+(.+?)\/\?`)
 )
 
+// refererParamRegex matches the value of a query parameter of the referer.
+func refererParamRegex(param string) *regexp.Regexp {
+	return regexp.MustCompile(`(?:.*[?&]` + regexp.QuoteMeta(param) + `=)([^&]+)`)
+}
+
 // CapturingResponseWriter a ResponseWriter that knows its response.
 type CapturingResponseWriter struct {
 	http.ResponseWriter
-	Body []byte
+	Body       []byte
+	StatusCode int
+	// Err is the first error writing to the client, Body is incomplete when set.
+	Err error
+
+	// Truncated is set when the response exceeded the body limit, Body is dropped then.
+	// When streaming Body keeps the part within the limit instead.
+	Truncated bool
+
+	// skipBody streams the response to the client without keeping it in Body.
+	skipBody bool
+	// maxBody is the limit of the captured body, 0 for no limit.
+	maxBody int64
+	// stream flushes every write to the client right away.
+	stream bool
+}
+
+// WriteHeader captures the status code.
+func (w *CapturingResponseWriter) WriteHeader(statusCode int) {
+	if w.StatusCode == 0 {
+		w.StatusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
 }
 
 func (w *CapturingResponseWriter) Write(b []byte) (int, error) {
-	// Capture the response body
-	w.Body = append(w.Body, b...)
-	return w.ResponseWriter.Write(b)
+	return w.writeCaptured(b, b)
+}
+
+// writeCaptured sends served to the client but captures a different body.
+func (w *CapturingResponseWriter) writeCaptured(served, captured []byte) (int, error) {
+	if w.StatusCode == 0 {
+		w.StatusCode = http.StatusOK
+	}
+	// Capture the response body, a body over the limit is of no use and only held in memory
+	if !w.skipBody && !w.Truncated {
+		switch {
+		case w.maxBody > 0 && int64(len(w.Body)+len(captured)) > w.maxBody && w.stream:
+			w.Truncated = true
+			w.Body = append(w.Body, captured[:w.maxBody-int64(len(w.Body))]...)
+		case w.maxBody > 0 && int64(len(w.Body)+len(captured)) > w.maxBody:
+			w.Truncated = true
+			w.Body = nil
+		default:
+			w.Body = append(w.Body, captured...)
+		}
+	}
+	n, err := w.ResponseWriter.Write(served)
+	if err != nil && w.Err == nil {
+		w.Err = err
+	}
+	if w.stream && err == nil {
+		w.Flush()
+	}
+	return n, err
+}
+
+// Flush sends the buffered response to the client, if the underlying writer supports it.
+func (w *CapturingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
 }
 
 // Function to decompress Gzip data.
-func decompressGzip(data []byte) string {
+// At most limit bytes are decompressed, 0 for no limit, to defuse decompression bombs.
+func decompressGzip(data []byte, limit int64) (string, error) {
 	reader, err := gzip.NewReader(bytes.NewBuffer(data))
 	if err != nil {
-		log.Fatalf("Failed to create Gzip reader: %v", err)
+		return "", fmt.Errorf("failed to create Gzip reader: %w", err)
 	}
-	defer func() {
-		if closeerr := reader.Close(); closeerr != nil {
-			log.Printf("Failed to close Gzip reader: %v", closeerr)
-		}
-	}()
+	// Close only reports the read errors ReadAll already returned
+	defer reader.Close()
 
-	decodedBody, readerr := io.ReadAll(reader)
+	decoded := io.Reader(reader)
+	if limit > 0 {
+		decoded = io.LimitReader(reader, limit+1)
+	}
+	decodedBody, readerr := io.ReadAll(decoded)
 	if readerr != nil {
-		log.Printf("Failed to read Gzip data: %v", readerr)
+		return "", fmt.Errorf("failed to read Gzip data: %w", readerr)
+	}
+	if limit > 0 && int64(len(decodedBody)) > limit {
+		return "", fmt.Errorf("gzip data decompresses to more than %d bytes", limit)
 	}
 
-	return string(decodedBody)
+	return string(decodedBody), nil
 }
 
 func (c *DashMiddleware) ServeHTTP(responseWriter http.ResponseWriter, req *http.Request) {
 	// Start a timer to measure the duration
-	var duration float64
-	startTime := time.Now()
+	startTime := c.now()
+
+	if c.metricsEnabled && req.URL.Path == c.metricsPath {
+		c.MetricsHandler().ServeHTTP(responseWriter, req)
+		return
+	}
+
+	if c.healthEnabled && req.URL.Path == c.healthPath {
+		c.HealthHandler().ServeHTTP(responseWriter, req)
+		return
+	}
+
+	// The session cookie may be one of the cookies filtered next
+	sessionID := c.requestSession(req)
+	remoteAddr, userAgent := c.clientIP(req), req.UserAgent()
 
 	// handle auth cookies
-	cookies := req.Header.Values("cookie")
-	req.Header.Del("cookie")
-
-	// restore non auth cookies
-	for _, cookieLine := range cookies {
-		cookies := splitRegexp.FindAllStringSubmatch(cookieLine, -1)
-		var keep []string
-		for _, cookie := range cookies {
-			if !strings.HasPrefix(cookie[1], "_oauth2_proxy") {
-				keep = append(keep, cookie[0])
-			}
-		}
-		if len(keep) > 0 {
-			req.Header.Add("cookie", strings.TrimSpace(strings.Join(keep, ";")))
-		}
+	if !c.filterCookies(req) {
+		http.Error(responseWriter, "too many cookies", http.StatusBadRequest)
+		return
 	}
 
 	// Get user information and remove groups (since they might be long)
-	email := req.Header.Values("X-Auth-Request-Email")
+	email := c.requestEmail(req.Header)
+	if c.primaryEmailOnly {
+		email = primaryEmail(email)
+	}
 	groups := req.Header.Values("X-Auth-Request-Groups")
 	req.Header.Del("X-Auth-Request-Groups")
 
 	// Get the long callback header
-	longcallback := req.Header.Values("X-Longcallback")
-	req.Header.Del("X-Longcallback")
+	longcallback := req.Header.Values(c.longCallbackHeader)
+	req.Header.Del(c.longCallbackHeader)
 	isLongCallback := len(longcallback) > 0
 
-	// Get the frame info from the referrer
+	// Get the frame info from the referrer, direct API clients send none
 	referer := req.Header.Get("Referer")
-	matches := frameRegex.FindStringSubmatch(referer)
-	frame := ""
-	if len(matches) > 1 {
-		frame = matches[1]
-	}
-	matches = layoutRegex.FindStringSubmatch(referer)
-	layout := ""
-	if len(matches) > 1 {
-		layout = matches[1]
+	frame, layout, refererBase := "", "", ""
+	if referer != "" {
+		if matches := c.frameRegex.FindStringSubmatch(referer); len(matches) > 1 {
+			frame = matches[1]
+		}
+		if matches := c.layoutRegex.FindStringSubmatch(referer); len(matches) > 1 {
+			layout = matches[1]
+		}
+		// A referer without a path has no base
+		if matches := c.baseURLRegex.FindStringSubmatch(referer); len(matches) > 1 {
+			refererBase = matches[1]
+		}
 	}
-	matches = baseURLRegex.FindStringSubmatch(referer)
-	refererBase := ""
-	if len(matches) > 1 {
-		refererBase = matches[1]
+
+	// Other sites must not embed the apps, warm requests have no site
+	warm := isWarmRequest(req)
+	refererAllowed := warm || c.refererAllowed(referer)
+
+	traefik := c.traefikMetadata(req.Header)
+	propagated := c.propagatedHeaders(req.Header)
+	captureMode := c.requestCaptureMode(req.Header)
+
+	// The middleware is a span of the trace, the parent of the backend calls and the app
+	root := c.startSpan(spanRequest, req.Header.Get(traceparentHeader))
+	defer c.endSpan(root)
+	if root != nil {
+		root.set("http.method", req.Method)
+		root.set("http.path", req.URL.Path)
+		root.set("dashmiddleware.frame", frame)
+		propagated.Set(traceparentHeader, root.traceparent())
+		req.Header.Set(traceparentHeader, root.traceparent())
 	}
 
-	// Use the context from the incoming request
-	ctx := req.Context()
-	_, cancel := context.WithTimeout(ctx, 10)
+	// Everything needed for tracking is extracted, the app does not need to see the internal headers
+	c.stripHeaders(req.Header)
+
+	// The backend calls of the request are bounded by the request timeout
+	ctx, cancel := c.withRequestTimeout(req.Context())
 	defer cancel()
 
-	// Read the request body
-	body, err := io.ReadAll(req.Body)
+	// Polls of long callbacks are answered by the poll backend
+	if c.pollPath != "" && req.URL.Path == c.pollPath {
+		if !c.groupsAllowed(groups) {
+			http.Error(responseWriter, "group not allowed", http.StatusForbidden)
+			return
+		}
+		c.servePoll(ctx, responseWriter, req, email, propagated)
+		return
+	}
+
+	// Read the request body, one byte over the limit tells it is exceeded
+	bodyReader := io.Reader(req.Body)
+	if c.maxBodyBytes > 0 {
+		bodyReader = io.LimitReader(req.Body, c.maxBodyBytes+1)
+	}
+	body, err := io.ReadAll(bodyReader)
 	if err != nil {
-		log.Printf("Failed to read request body: %v", err)
+		// The body is partial, it must neither reach the downstream nor be tracked
+		c.logger.Error("Failed to read request body", "error", err)
+		http.Error(responseWriter, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if c.maxBodyBytes > 0 && int64(len(body)) > c.maxBodyBytes {
+		http.Error(responseWriter, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
 		return
 	}
 	// Restore the original request body for downstream handlers
@@ -169,217 +1506,454 @@ func (c *DashMiddleware) ServeHTTP(responseWriter http.ResponseWriter, req *http
 	// Check if the URL matches any of the RecordedURLs
 	url := req.URL.String()
 
-	// If the layout is not empty and the URL matches, send the request to layoutURL
-	if layout != "" && strings.HasSuffix(url, "/_dash-layout") {
-		requestData := LayoutRequestData{
-			Email:  email,
-			Layout: layout,
-			Frame:  frame,
+	// Preflight requests are never layout handled or recorded
+	if req.Method == http.MethodOptions {
+		if len(c.corsAllowOrigins) > 0 && c.isLayoutURL(url) {
+			c.servePreflight(responseWriter, req)
+			return
 		}
+		c.next.ServeHTTP(responseWriter, req)
+		return
+	}
 
-		// Serialize the request data to JSON
-		requestBody, jsonReqErr := json.Marshal(requestData)
-		if jsonReqErr != nil {
-			log.Printf("Failed to serialize request data to JSON: %v", jsonReqErr)
-			return
+	// Without identifiers in the referer, the layout request may carry them in its body
+	layoutFrame := frame
+	if layout == "" && c.isLayoutURL(url) && len(body) > 0 {
+		var bodyFrame string
+		layout, bodyFrame = layoutFromBody(body)
+		if layoutFrame == "" {
+			layoutFrame = bodyFrame
 		}
+	}
 
-		resp, postErr := http.Post(c.layoutURL, "application/json", bytes.NewBuffer(requestBody))
-		if postErr != nil {
-			log.Printf("Failed to send request to layoutURL: %v", postErr)
+	// If the layout is not empty and the URL matches, send the request to layoutURL
+	if refererAllowed && !c.observeOnly && c.isLayoutRequest(url, layout) {
+		c.allowLayoutOrigin(responseWriter, req)
+		// A page wall loading at once must not overwhelm the layout backend
+		releaseLayout, ok := c.acquireLayout(ctx)
+		if !ok {
+			http.Error(responseWriter, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 			return
 		}
-		defer func() {
-			if closeErr := resp.Body.Close(); closeErr != nil {
-				log.Printf("Error closing response body: %v", closeErr)
+		err = c.serveLayout(ctx, responseWriter, propagated, LayoutRequestData{
+			Email:  email,
+			Layout: layout,
+			Frame:  layoutFrame,
+		})
+		releaseLayout()
+		if err != nil {
+			c.logger.Error("Failed to get the layout", "error", err)
+			if stage := timeoutStage(ctx, err, timeoutStageLayout); stage != "" {
+				c.timedOut(responseWriter, stage)
+				return
 			}
-		}()
-
-		// Check the response status code from the external API
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Failed to send request to layoutURL. Status Code: %d", resp.StatusCode)
-			return
+			c.backendFailed(responseWriter, req)
 		}
+		return
+	}
 
-		// Copy the response from resp to responseWriter and return
-		layoutBody, readAllErr := io.ReadAll(resp.Body)
-		if readAllErr != nil {
-			log.Printf("Failed to read layout body: %v", readAllErr)
+	// find out if the url is in the recorded ones
+	pattern, matched := c.matchRecordedURL(url, req.URL.Path)
+	if !matched {
+		if c.sampleNonRecorded() {
+			c.serveNonRecorded(responseWriter, req, &recordedRequest{
+				startTime:   startTime,
+				url:         url,
+				email:       email,
+				groups:      groups,
+				frame:       frame,
+				referer:     referer,
+				refererBase: refererBase,
+				traefik:     traefik,
+				sessionID:   sessionID,
+				remoteAddr:  remoteAddr,
+				userAgent:   userAgent,
+				propagated:  propagated,
+			})
 			return
 		}
+		c.next.ServeHTTP(responseWriter, req)
+		return
+	}
 
-		responseWriter.Header().Set("Content-Type", "application/json")
-		_, err = responseWriter.Write(layoutBody)
-		if err != nil {
-			log.Printf("Problem sending body to the responsewriter: %v", err)
-			return
-		}
+	root.set("dashmiddleware.pattern", pattern)
+
+	// Observing only, nothing is enforced
+	if !refererAllowed && c.rejectDisallowedReferers && !c.observeOnly {
+		http.Error(responseWriter, "referer not allowed", http.StatusForbidden)
 		return
 	}
 
-	// find out if the url is in the recorded ones
-	matched := false
-	for _, recordedURL := range c.recordedURLs {
-		if strings.HasSuffix(url, recordedURL) {
-			matched = true
-			break
-		}
+	if c.requireReferer && !c.observeOnly && !warm && !validReferer(referer) {
+		http.Error(responseWriter, "missing or invalid referer", http.StatusBadRequest)
+		return
 	}
 
-	if !matched {
-		c.next.ServeHTTP(responseWriter, req)
+	if !c.observeOnly && !c.groupsAllowed(groups) {
+		http.Error(responseWriter, "group not allowed", http.StatusForbidden)
+		return
+	}
+
+	if !c.observeOnly && c.rateLimited(responseWriter, email, groups) {
+		return
+	}
+
+	release, ok := c.acquireRecorded(responseWriter, req)
+	if !ok {
 		return
 	}
+	defer release()
 
 	// Create a capturing response writer
 	capturingWriter := &CapturingResponseWriter{
 		ResponseWriter: responseWriter,
 		Body:           []byte{},
+		skipBody:       captureMode != captureModeFull,
+		maxBody:        c.maxBodyBytes,
+		stream:         c.streamResponses,
 	}
 
-	payload := map[string]interface{}{
-		"Request":      string(body),
-		"URL":          url,
-		"longcallback": isLongCallback,
+	keyURL := c.keyURL(c.effectiveMethod(req), req.URL)
+	rec := &recordedRequest{
+		startTime:       startTime,
+		body:            body,
+		contentType:     req.Header.Get("Content-Type"),
+		contentEncoding: req.Header.Get("Content-Encoding"),
+		header:          req.Header,
+		url:             url,
+		keyURL:          keyURL,
+		key:             c.cacheKey(keyURL, body),
+		email:           email,
+		groups:          groups,
+		frame:           frame,
+		referer:         referer,
+		refererBase:     refererBase,
+		isLongCallback:  isLongCallback,
+		traefik:         traefik,
+		captureMode:     captureMode,
+		pattern:         pattern,
+		cacheable:       c.isCacheable(c.effectiveMethod(req), url),
+		capturingWriter: capturingWriter,
+		// Only every Nth recorded request is tracked when sampling deterministically
+		skipTrack: c.trackEveryN > 1 && atomic.AddInt64(&c.recordedCount, 1)%c.trackEveryN != 0,
 	}
 
-	// Marshal the payload into a JSON string
-	payloadJSON, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to create JSON payload: %v", err)
-		return
+	// Responses of the pattern vary on request headers, which are part of their key then
+	rec.key = varyKey(rec.key, req.Header, c.vary.get(pattern))
+
+	rec.sessionID = sessionID
+	rec.remoteAddr, rec.userAgent = remoteAddr, userAgent
+	rec.propagated = propagated
+
+	// Service identity of mTLS clients
+	if c.captureClientCert && req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		rec.clientCert = req.TLS.PeerCertificates[0].Subject.CommonName
 	}
 
-	// Make a request to the external REST API to check for a recorded result
-	cached := false
-	resp, err := http.Post(c.resultURL, "application/json", bytes.NewBuffer(payloadJSON))
-	if err != nil {
-		log.Printf("Failed to get cached request: %v", err)
+	// Whatever happens after this point, a served response gets tracked
+	defer c.trackRecorded(rec)
+	defer c.recordPanic(rec)
+
+	if c.debugCacheKeyHeader != "" {
+		responseWriter.Header().Set(c.debugCacheKeyHeader, rec.key)
 	}
 
-	if resp.StatusCode == http.StatusOK {
-		cached = true
-		// copy the header
-		for key, values := range resp.Header {
-			for _, value := range values {
-				responseWriter.Header().Add(key, value)
+	// Observing only, long callbacks are computed by the app like any other callback
+	shortCircuitLong := isLongCallback && !c.observeOnly
+
+	// A long callback gets a job ID when it can be polled
+	jobID := ""
+	if shortCircuitLong && c.pollPath != "" {
+		jobID = newJobID()
+	}
+
+	// A long callback the user already submitted is pending, it is looked up without queuing it twice
+	jobKey := strings.Join(email, ",") + "\x00" + rec.key
+	deduplicated := false
+	if shortCircuitLong && rec.cacheable && c.longCallbackJobs != nil {
+		if pendingID, ok := c.longCallbackJobs.claim(jobKey, jobID, c.now()); !ok {
+			deduplicated = true
+			jobID = pendingID
+		}
+	}
+
+	// Make a request to the external REST API to check for a recorded result
+	var resp *backendResponse
+	lookupFailed := false
+	if rec.cacheable && !c.observeOnly {
+		lookupStart := c.now()
+		lookup := func(ctx context.Context) (*backendResponse, error) {
+			payload := map[string]interface{}{
+				"Request":      string(body),
+				"URL":          url,
+				"Key":          rec.key,
+				"longcallback": isLongCallback && !deduplicated,
+				"Method":       req.Method,
+				"Query":        c.lookupQuery(req.URL.RawQuery),
+			}
+			if c.cacheKeyVersion != "" {
+				payload["KeyVersion"] = c.cacheKeyVersion
+			}
+			if jobID != "" && !deduplicated {
+				payload["JobID"] = jobID
+			}
+			if ttl := c.cacheTTL(frame); ttl > 0 {
+				payload["TTL"] = ttl.Seconds()
+			}
+			return c.lookupResult(ctx, payload, propagated)
+		}
+		var local bool
+		if c.localCache != nil {
+			resp, local = c.localCache.get(rec.key, c.now())
+		}
+		switch {
+		case local:
+			c.metrics.inc("dashmiddleware_local_cache_hits_total", "pattern", pattern)
+		case c.feature(featureCoalesce) && !isLongCallback:
+			// A long callback queues a job of its own, it never shares the lookup of another request
+			resp, err = c.lookupGroup.do(ctx, rec.key, func() (*backendResponse, error) {
+				shared, cancel := c.withCallTimeout(c.lifecycle, c.resultLookupTimeout)
+				defer cancel()
+				return lookup(shared)
+			})
+		default:
+			resp, err = lookup(ctx)
+		}
+		rec.lookupDuration = c.now().Sub(lookupStart).Seconds()
+		// A gzip cached result is replayed decompressed. One that is corrupt or decompresses past
+		// the limit is known before anything is written, it fails like the backend
+		if err == nil && resp != nil && resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Encoding") == "gzip" {
+			resp, err = c.decompressCached(resp)
+		}
+		// A failed lookup queued nothing, a long callback is computed by the app then
+		lookupFailed = err != nil || resp == nil || resp.StatusCode >= http.StatusInternalServerError
+		stage := timeoutStage(ctx, err, timeoutStageResultLookup)
+		switch {
+		case stage == timeoutStageRequest:
+			// The request ran out of time as a whole, it is not a slow cache to treat as a miss
+			c.logger.Error("Timed out getting cached request", "error", err, "stage", stage)
+			rec.timeoutStage = stage
+		case stage == timeoutStageResultLookup:
+			// A slow result backend is worse than an unreachable one, it holds every request
+			c.logger.Error("Timed out getting cached request", "error", err)
+			c.metrics.inc("dashmiddleware_result_lookup_timeouts_total", "pattern", pattern)
+			if c.onResultTimeout == resultTimeoutFailClosed {
+				rec.timeoutStage = stage
 			}
+		case err != nil:
+			c.logger.Error("Failed to get cached request", "error", err)
+			rec.backendFailed = !c.failOpen
+		case resp == nil:
+			c.logger.Error("Failed to get cached request", "error", "no response")
+			rec.backendFailed = !c.failOpen
+		case resp.StatusCode >= http.StatusInternalServerError:
+			c.logger.Error("Failed to get cached request", "status", resp.StatusCode)
+			rec.backendFailed = !c.failOpen
+		}
+		// Only a miss queues the long callback, otherwise the next submission has to try again.
+		// A finished job is not pending anymore, a failed lookup of a duplicate leaves it pending
+		hit := !lookupFailed && resp.StatusCode == http.StatusOK
+		if (hit || lookupFailed && !deduplicated) && shortCircuitLong && c.longCallbackJobs != nil {
+			c.longCallbackJobs.release(jobKey)
 		}
 
-		// Set the status code
-		responseWriter.WriteHeader(http.StatusOK)
+		// The pending job is still running, the duplicate is answered like its submission
+		if deduplicated && !hit {
+			c.metrics.inc("dashmiddleware_long_callback_deduplicated_total")
+			rec.skipTrack = true
+			if jobID != "" {
+				responseWriter.Header().Set("Location", c.pollLocation(jobID))
+			}
+			responseWriter.WriteHeader(http.StatusAccepted)
+			return
+		}
 
-		// Check if the response is gzip encoded
-		if resp.Header.Get("Content-Encoding") == "gzip" {
-			gzipReader, zipErr := gzip.NewReader(resp.Body)
-			if zipErr != nil {
-				log.Printf("Failed to create gzip reader: %v", zipErr)
-				return
+		// The backend may name the job it queued itself
+		if resp != nil && jobID != "" && resp.Header.Get(jobIDHeader) != "" {
+			jobID = resp.Header.Get(jobIDHeader)
+			if c.longCallbackJobs != nil {
+				c.longCallbackJobs.setJobID(jobKey, jobID)
 			}
-			defer func() {
-				if closeErr := gzipReader.Close(); closeErr != nil {
-					log.Printf("Failed to close gzip reader: %v", closeErr)
-				}
-			}()
+		}
 
-			// Capture the response and use it as the response with a limit to prevent decompression bomb
-			limitedReader := io.LimitReader(gzipReader, 10<<20) // 10 MB limit
-			_, copyErr := io.Copy(capturingWriter, limitedReader)
-			if copyErr != nil {
-				log.Printf("Failed to copy gzip response body: %v", copyErr)
-				return
+		if resp != nil && resp.StatusCode == http.StatusOK {
+			c.metrics.inc("dashmiddleware_cache_hits_total", "pattern", pattern)
+			if c.localCache != nil && !local {
+				if expiresAt, ok := c.localCacheExpiry(resp, frame, c.now()); ok {
+					c.localCache.add(rec.key, resp, expiresAt)
+				}
 			}
 		} else {
-			// Capture the response and use it as the response
-			_, copyErr := io.Copy(capturingWriter, resp.Body)
-			if copyErr != nil {
-				log.Printf("Failed to copy response body: %v", copyErr)
-				return
+			c.metrics.inc("dashmiddleware_cache_misses_total", "pattern", pattern)
+		}
+	}
+
+	switch {
+	case rec.timeoutStage != "":
+		// Deadlines get a consistent answer and are tracked with the stage that timed out
+		writeTimeout(responseWriter)
+	case rec.backendFailed:
+		// Failing closed, the response is no result of the app and is not tracked
+		rec.skipTrack = true
+		c.backendFailed(responseWriter, req)
+	case resp != nil && resp.StatusCode == http.StatusOK:
+		rec.cached = true
+		root.set("dashmiddleware.cache_hit", true)
+
+		// copy the header, the framing of the backend response does not apply to the replay
+		for key, values := range resp.Header {
+			if key == "Transfer-Encoding" || key == "Connection" || key == "Trailer" {
+				continue
+			}
+			for _, value := range values {
+				responseWriter.Header().Add(key, value)
 			}
 		}
 
-		closeErr := resp.Body.Close()
-		if closeErr != nil {
-			log.Printf("Failed to close response: %v", closeErr)
-			return
+		// Tell the front-end that the response came from the cache, the cache keeps the original
+		served := resp.Body
+		if c.injectCacheMetadata {
+			if injected, ok := injectCacheMetadata(resp.Header.Get("Content-Type"), resp.Body, cacheAge(resp.Header)); ok {
+				served = injected
+			}
 		}
-	} else {
-		// If we have a long callback, we send back a 202 and put the request in the queue
-		if isLongCallback {
-			responseWriter.WriteHeader(http.StatusAccepted)
+
+		// The body is fully buffered, so its length is known and the response does not need chunking,
+		// unless trailers follow it
+		if len(resp.Trailer) == 0 {
+			responseWriter.Header().Set("Content-Length", strconv.Itoa(len(served)))
+		}
+
+		// Trailers of the cached result are sent after its body
+		declareTrailers(responseWriter.Header(), resp.Trailer)
+		defer writeTrailers(responseWriter.Header(), resp.Trailer)
+
+		// Set the status code
+		responseWriter.WriteHeader(http.StatusOK)
+
+		// Capture the response and use it as the response
+		_, copyErr := capturingWriter.writeCaptured(served, resp.Body)
+		if copyErr != nil {
+			c.logger.Debug("Failed to copy response body", "error", copyErr)
 			return
 		}
 
+		// Shadow recompute of a sample of the hits, to catch stale or wrong cache entries
+		if c.sampleCacheValidation() {
+			c.validateCached(req, body, pattern, resp.Body)
+		}
+	case shortCircuitLong && !lookupFailed:
+		// If we have a long callback, we send back a 202 and put the request in the queue
+		rec.skipTrack = true
+		c.metrics.inc("dashmiddleware_long_callback_accepted_total", "pattern", pattern)
+		if jobID != "" {
+			responseWriter.Header().Set("Location", c.pollLocation(jobID))
+		}
+		responseWriter.WriteHeader(http.StatusAccepted)
+	default:
 		// Continue the request down the middleware chain with the capturing response writer
-		c.next.ServeHTTP(capturingWriter, req)
+		rec.requestBody = &countingReader{ReadCloser: req.Body}
+		req.Body = rec.requestBody
+		downstreamStart := c.now()
+		downstream := c.startChildSpan(spanDownstream, req.Header)
+		// A streamed response is not held back until it is known to be in time
+		stream := capturingWriter.stream || capturingWriter.skipBody
+		if c.serveDownstream(capturingWriter, req, stream) {
+			rec.timeoutStage = timeoutStageDownstream
+			// A streamed response that already started can only be cut off
+			if capturingWriter.StatusCode == 0 {
+				writeTimeout(responseWriter)
+			}
+		}
+		rec.downstreamDuration = c.now().Sub(downstreamStart).Seconds()
+		downstream.set("http.status_code", capturingWriter.StatusCode)
+		c.endSpan(downstream)
 	}
+}
 
-	// Calculate the duration
-	duration = time.Since(startTime).Seconds()
-
-	contentEncoding := capturingWriter.ResponseWriter.Header().Get("Content-Encoding")
-	var result string
-	if contentEncoding == "gzip" {
-		result = decompressGzip(capturingWriter.Body)
-	} else {
-		result = string(capturingWriter.Body)
+// backendFailed answers a request whose backend call failed, falling through to the app when failing open.
+func (c *DashMiddleware) backendFailed(responseWriter http.ResponseWriter, req *http.Request) {
+	if c.failOpen {
+		c.next.ServeHTTP(responseWriter, req)
+		return
 	}
+	http.Error(responseWriter, "backend unavailable", http.StatusBadGateway)
+}
 
-	// Define the JSON payload to send in the request body
-	payload = map[string]interface{}{
-		"Request":     string(body),
-		"Result":      result,
-		"URL":         url,
-		"Email":       email,
-		"Groups":      groups,
-		"Frame":       frame,
-		"Cached":      cached,
-		"Duration":    duration,
-		"RefererBase": refererBase,
+// decompressCached returns a gzip cached result decompressed, bounded by the decompression limit.
+// A result over the limit is an error rather than a truncated body served as the result.
+func (c *DashMiddleware) decompressCached(resp *backendResponse) (*backendResponse, error) {
+	decompressed, err := decompressGzip(resp.Body, c.maxDecompressedBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cached result: %w", err)
 	}
 
+	header := resp.Header.Clone()
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	return &backendResponse{StatusCode: resp.StatusCode, Header: header, Body: []byte(decompressed), Trailer: resp.Trailer}, nil
+}
+
+// backendResponse a fully read response of a backend call.
+type backendResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Trailer is only known once the body was read.
+	Trailer http.Header
+}
+
+// lookupResult asks the backend for a recorded result, bounded by the result lookup timeout.
+func (c *DashMiddleware) lookupResult(ctx context.Context, payload map[string]interface{}, header http.Header) (*backendResponse, error) {
 	// Marshal the payload into a JSON string
-	payloadJSON, err = json.Marshal(payload)
+	payloadJSON, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Failed to create JSON payload: %v", err)
-		return
+		return nil, fmt.Errorf("failed to create JSON payload: %w", err)
 	}
 
-	// Create a new request for the external REST API
-	trackReq, err := http.NewRequest(http.MethodPost, c.trackURL, bytes.NewBuffer(payloadJSON))
-	if err != nil {
-		log.Printf("Failed to create API request: %v", err)
-		return
+	if c.resultLookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.resultLookupTimeout)
+		defer cancel()
 	}
 
-	// Copy headers from the original request to the new request
-	expires := capturingWriter.ResponseWriter.Header().Get("Expires")
-	trackReq.Header.Add("Expires", expires)
-
-	// Set the Content-Type header for the new request
-	contentType := capturingWriter.ResponseWriter.Header().Get("Content-Type")
-	trackReq.Header.Set("Content-Type", contentType)
+	// A restarting backend is retried, the lookup is idempotent
+	for attempt := 0; ; attempt++ {
+		result, err := c.sendLookup(ctx, payloadJSON, header)
+		if !retryable(ctx, result, err) || attempt >= c.maxRetries {
+			return result, err
+		}
+		c.logger.Info("Retrying result lookup", "attempt", attempt+1, "retries", c.maxRetries)
+		if !c.backoff(ctx, attempt) {
+			return result, err
+		}
+	}
+}
 
-	// Check if the data is compressed
-	if contentEncoding == "gzip" {
-		trackReq.Header.Set("Content-Encoding", "gzip")
+// sendLookup posts a marshaled lookup payload to the result backend once.
+func (c *DashMiddleware) sendLookup(ctx context.Context, payloadJSON []byte, header http.Header) (*backendResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.resultURL, bytes.NewBuffer(payloadJSON))
+	if err != nil {
+		return nil, err
 	}
+	copyHeader(req.Header, header)
+	req.Header.Set("Content-Type", "application/json")
+	c.authorize(req)
 
-	// Make a request to the external REST API with headers from the original request
-	resp, err = http.DefaultClient.Do(trackReq)
+	resp, err := c.doBackend(backendResult, req)
 	if err != nil {
-		log.Printf("Failed to track request: %v, URL: %s, Content-Type: %s, Encoding: %s", err, url, contentType, contentEncoding)
-		return
+		return nil, err
 	}
 	defer func() {
 		if closeErr := resp.Body.Close(); closeErr != nil {
-			log.Printf("Error closing response body: %v", closeErr)
+			c.logger.Debug("Failed to close response", "error", closeErr)
 		}
 	}()
 
-	// Check the response status code from the external API
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Failed to track request. Status Code: %d", resp.StatusCode)
-		return
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
+
+	return &backendResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: body, Trailer: resp.Trailer}, nil
 }
@@ -1,7 +1,4827 @@
 package dashmiddleware_test
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
 
-func TestDashMiddleware(_ *testing.T) {
-	// test all the features
+	"github.com/dashpool/dashmiddleware"
+)
+
+// backendCall a request received by the stub backend.
+type backendCall struct {
+	Header  http.Header
+	Body    []byte
+	Payload map[string]interface{}
+}
+
+// stubBackend fakes the Dashpool backend, results are misses unless a handler is set.
+type stubBackend struct {
+	*httptest.Server
+	mu     sync.Mutex
+	calls  map[string][]backendCall
+	result http.HandlerFunc
+	layout http.HandlerFunc
+	track  http.HandlerFunc
+	poll   http.HandlerFunc
+}
+
+func newStubBackend(t *testing.T) *stubBackend {
+	t.Helper()
+
+	b := &stubBackend{calls: map[string][]backendCall{}}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		call := backendCall{Header: req.Header.Clone(), Body: body}
+		_ = json.Unmarshal(body, &call.Payload)
+
+		b.mu.Lock()
+		b.calls[req.URL.Path] = append(b.calls[req.URL.Path], call)
+		result, layout, track, poll := b.result, b.layout, b.track, b.poll
+		b.mu.Unlock()
+
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/result") && result != nil:
+			result(rw, req)
+		case strings.HasPrefix(req.URL.Path, "/result"):
+			rw.WriteHeader(http.StatusNotFound)
+		case strings.HasPrefix(req.URL.Path, "/getlayout") && layout != nil:
+			layout(rw, req)
+		case strings.HasPrefix(req.URL.Path, "/track") && track != nil:
+			track(rw, req)
+		case strings.HasPrefix(req.URL.Path, "/poll") && poll != nil:
+			poll(rw, req)
+		default:
+			rw.WriteHeader(http.StatusOK)
+		}
+	}))
+	t.Cleanup(b.Close)
+
+	return b
+}
+
+func (b *stubBackend) Calls(path string) []backendCall {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]backendCall(nil), b.calls[path]...)
+}
+
+func (b *stubBackend) config() *dashmiddleware.Config {
+	cfg := dashmiddleware.CreateConfig()
+	cfg.TrackURL = b.URL + "/track"
+	cfg.ResultURL = b.URL + "/result"
+	cfg.LayoutURL = b.URL + "/getlayout"
+
+	return cfg
+}
+
+func newHandler(t *testing.T, cfg *dashmiddleware.Config, next http.Handler) http.Handler {
+	t.Helper()
+
+	if next == nil {
+		next = http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			_, _ = rw.Write([]byte(`{"response":"ok"}`))
+		})
+	}
+
+	handler, err := dashmiddleware.New(context.Background(), next, cfg, "dashmiddleware-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return handler
+}
+
+func newCallbackRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/app/_dash-update-component", strings.NewReader(body))
+	req.Header.Set("Referer", "https://localhost/app/?frame=frame1")
+	req.Header.Set("X-Auth-Request-Email", "user@example.com")
+
+	return req
+}
+
+func cachedResult(body string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(body))
+	}
+}
+
+func TestDashMiddleware(t *testing.T) {
+	backend := newStubBackend(t)
+	handler := newHandler(t, backend.config(), nil)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"response":"ok"}` {
+		t.Fatalf("unexpected response %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track call, got %d", len(tracks))
+	}
+	if got := tracks[0].Payload["Result"]; got != `{"response":"ok"}` {
+		t.Errorf("unexpected tracked result %v", got)
+	}
+	if got := tracks[0].Payload["Frame"]; got != "frame1" {
+		t.Errorf("unexpected tracked frame %v", got)
+	}
+}
+
+func TestTrackRoutes(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.result = cachedResult(`{"response":"cached"}`)
+
+	cfg := backend.config()
+	cfg.TrackRoutes = []dashmiddleware.TrackRoute{
+		{LongCallback: true, TrackURL: backend.URL + "/track-long"},
+		{FramePrefix: "reports-", TrackURL: backend.URL + "/track-reports"},
+	}
+	handler := newHandler(t, cfg, nil)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("X-Longcallback", "1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":2}`))
+
+	req = newCallbackRequest(`{"input":3}`)
+	req.Header.Set("Referer", "https://localhost/app/?frame=reports-sales")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if n := len(backend.Calls("/track-long")); n != 1 {
+		t.Errorf("expected the long callback on the dedicated backend, got %d calls", n)
+	}
+	if n := len(backend.Calls("/track-reports")); n != 1 {
+		t.Errorf("expected the frame prefix route to match once, got %d calls", n)
+	}
+	if n := len(backend.Calls("/track")); n != 1 {
+		t.Errorf("expected the normal callback on the default backend, got %d calls", n)
+	}
+}
+
+func grpcWebFrame(flag byte, data string) []byte {
+	frame := []byte{flag, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+func TestGrpcWebTrailers(t *testing.T) {
+	tests := []struct {
+		name   string
+		next   http.HandlerFunc
+		status float64
+	}{
+		{"trailer frame", func(rw http.ResponseWriter, _ *http.Request) {
+			rw.Header().Set("Content-Type", "application/grpc-web+proto")
+			_, _ = rw.Write(grpcWebFrame(0x00, "message"))
+			_, _ = rw.Write(grpcWebFrame(0x80, "grpc-status: 13\r\ngrpc-message: internal\r\n"))
+		}, 13},
+		{"trailers only", func(rw http.ResponseWriter, _ *http.Request) {
+			rw.Header().Set("Content-Type", "application/grpc-web+proto")
+			rw.Header().Set("Grpc-Status", "5")
+			rw.Header().Set("Grpc-Message", "not found")
+		}, 5},
+		{"text chunks", func(rw http.ResponseWriter, _ *http.Request) {
+			rw.Header().Set("Content-Type", "application/grpc-web-text")
+			// Every frame is its own padded base64 chunk
+			_, _ = rw.Write([]byte(base64.StdEncoding.EncodeToString(grpcWebFrame(0x00, "messages"))))
+			_, _ = rw.Write([]byte(base64.StdEncoding.EncodeToString(grpcWebFrame(0x80, "grpc-status: 14\r\n"))))
+		}, 14},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			handler := newHandler(t, backend.config(), test.next)
+
+			handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			if got := tracks[0].Payload["GrpcStatus"]; got != test.status {
+				t.Errorf("expected grpc status %v, got %v", test.status, got)
+			}
+			if got := tracks[0].Payload["Error"]; got != true {
+				t.Errorf("expected a non-zero grpc status to be tracked as error, got %v", got)
+			}
+		})
+	}
+}
+
+func TestCacheResultNormalizers(t *testing.T) {
+	backend := newStubBackend(t)
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte(`{"dash_clientside":{"nonce":"a1b2c3"},"value":1}`))
+	})
+
+	cfg := backend.config()
+	cfg.CacheResultNormalizers = []dashmiddleware.Normalizer{
+		{Pattern: `"nonce":"[^"]*"`, Replacement: `"nonce":""`},
+	}
+	handler := newHandler(t, cfg, next)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+	if got := recorder.Body.String(); got != `{"dash_clientside":{"nonce":"a1b2c3"},"value":1}` {
+		t.Errorf("expected the client to get the original result, got %q", got)
+	}
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track call, got %d", len(tracks))
+	}
+	if got := tracks[0].Payload["Result"]; got != `{"dash_clientside":{"nonce":""},"value":1}` {
+		t.Errorf("expected the stored result to be normalized, got %v", got)
+	}
+}
+
+func TestCacheResultNormalizersInvalidPattern(t *testing.T) {
+	cfg := dashmiddleware.CreateConfig()
+	cfg.CacheResultNormalizers = []dashmiddleware.Normalizer{{Pattern: `(`}}
+
+	if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
+
+// fakeClock a clock that only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestTimings(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	backend := newStubBackend(t)
+	backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+		clock.Advance(50 * time.Millisecond)
+		rw.WriteHeader(http.StatusNotFound)
+	}
+	handler := newHandler(t, backend.config(), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		clock.Advance(200 * time.Millisecond)
+		_, _ = rw.Write([]byte(`{"response":"ok"}`))
+	}))
+	handler.(*dashmiddleware.DashMiddleware).SetClock(clock.Now)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track call, got %d", len(tracks))
+	}
+	timings, ok := tracks[0].Payload["Timings"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a timings object, got %v", tracks[0].Payload["Timings"])
+	}
+	expected := map[string]interface{}{"resultLookup": 0.05, "downstream": 0.2, "track": 0.0, "total": 0.25}
+	if !reflect.DeepEqual(timings, expected) {
+		t.Errorf("expected the timings %v, got %v", expected, timings)
+	}
+}
+
+func TestMaxTrackPayloadBytes(t *testing.T) {
+	large := `{"value":"` + strings.Repeat("x", 4096) + `"}`
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte(large))
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		backend := newStubBackend(t)
+		cfg := backend.config()
+		cfg.MaxTrackPayloadBytes = 1024
+		handler := newHandler(t, cfg, next)
+
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+		if n := len(backend.Calls("/track")); n != 0 {
+			t.Errorf("expected the oversized track to be dropped, got %d calls", n)
+		}
+		middleware := handler.(*dashmiddleware.DashMiddleware)
+		if n := middleware.Counter("dashmiddleware_track_dropped_total", "reason", "payload_too_large"); n != 1 {
+			t.Errorf("expected one dropped track to be counted, got %d", n)
+		}
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		backend := newStubBackend(t)
+		cfg := backend.config()
+		cfg.MaxTrackPayloadBytes = 1024
+		cfg.OversizedTrack = "metadata"
+		handler := newHandler(t, cfg, next)
+
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+		tracks := backend.Calls("/track")
+		if len(tracks) != 1 {
+			t.Fatalf("expected a metadata only track call, got %d", len(tracks))
+		}
+		if _, found := tracks[0].Payload["Result"]; found {
+			t.Error("expected the result to be stripped")
+		}
+		if got := tracks[0].Payload["ResultOmitted"]; got != true {
+			t.Errorf("expected the result to be flagged as omitted, got %v", got)
+		}
+	})
+}
+
+func TestPrimaryEmailOnly(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		primaryEmailOnly bool
+		expected         []interface{}
+	}{
+		{name: "all addresses", expected: []interface{}{"first@example.com, second@example.com", "third@example.com"}},
+		{name: "primary address", primaryEmailOnly: true, expected: []interface{}{"first@example.com"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			backend.layout = cachedResult(`{"layout":"ok"}`)
+			cfg := backend.config()
+			cfg.PrimaryEmailOnly = tc.primaryEmailOnly
+			handler := newHandler(t, cfg, nil)
+
+			req := newCallbackRequest(`{"input":1}`)
+			req.Header.Set("X-Auth-Request-Email", "first@example.com, second@example.com")
+			req.Header.Add("X-Auth-Request-Email", "third@example.com")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			req = httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+			req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+			req.Header.Set("X-Auth-Request-Email", "first@example.com, second@example.com")
+			req.Header.Add("X-Auth-Request-Email", "third@example.com")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			tracks := backend.Calls("/track")
+			layouts := backend.Calls("/getlayout")
+			if len(tracks) != 1 || len(layouts) != 1 {
+				t.Fatalf("expected one track and one layout call, got %d and %d", len(tracks), len(layouts))
+			}
+			if got := tracks[0].Payload["Email"]; !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("unexpected tracked email %v", got)
+			}
+			if got := layouts[0].Payload["email"]; !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("unexpected layout email %v", got)
+			}
+		})
+	}
+}
+
+// disconnectingWriter fails every write after the first, like a client that went away.
+type disconnectingWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *disconnectingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		return 0, io.ErrClosedPipe
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestClientDisconnect(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte(`{"partial":`))
+		_, _ = rw.Write([]byte(`"result"}`))
+	})
+
+	for _, trackAborted := range []bool{false, true} {
+		backend := newStubBackend(t)
+		cfg := backend.config()
+		cfg.TrackAborted = trackAborted
+		handler := newHandler(t, cfg, next)
+
+		handler.ServeHTTP(&disconnectingWriter{ResponseRecorder: httptest.NewRecorder()}, newCallbackRequest(`{"input":1}`))
+
+		tracks := backend.Calls("/track")
+		if !trackAborted {
+			if len(tracks) != 0 {
+				t.Errorf("expected no track call for an aborted request, got %d", len(tracks))
+			}
+			continue
+		}
+		if len(tracks) != 1 {
+			t.Fatalf("expected the aborted request to be tracked, got %d calls", len(tracks))
+		}
+		if got := tracks[0].Payload["Aborted"]; got != true {
+			t.Errorf("expected the request to be tracked as aborted, got %v", got)
+		}
+		if got := tracks[0].Payload["Result"]; got != "" {
+			t.Errorf("expected the partial result not to be offered to the cache, got %v", got)
+		}
+	}
+}
+
+func TestWarm(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.result = func(rw http.ResponseWriter, req *http.Request) {
+		if len(backend.Calls("/track")) == 0 {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		cachedResult(`{"response":"cached"}`)(rw, req)
+	}
+
+	downstreamCalls := 0
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		downstreamCalls++
+		_, _ = rw.Write([]byte(`{"response":"ok"}`))
+	})
+	middleware := newHandler(t, backend.config(), next).(*dashmiddleware.DashMiddleware)
+
+	err := middleware.Warm(context.Background(), []dashmiddleware.WarmRequest{
+		{URL: "http://localhost/app/_dash-update-component", Body: `{"input":1}`, Email: "warm@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(backend.Calls("/track")); n != 1 || downstreamCalls != 1 {
+		t.Fatalf("expected warming to run downstream and track once, got %d downstream and %d track calls", downstreamCalls, n)
+	}
+
+	recorder := httptest.NewRecorder()
+	middleware.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+	if got := recorder.Body.String(); got != `{"response":"cached"}` {
+		t.Errorf("expected a cache hit after warming, got %q", got)
+	}
+	if downstreamCalls != 1 {
+		t.Errorf("expected the cache hit to skip downstream, got %d downstream calls", downstreamCalls)
+	}
+}
+
+func TestWarmRefererChecks(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.RequireReferer = true
+	cfg.AllowedRefererHosts = []string{"example.com"}
+	cfg.RejectDisallowedReferers = true
+
+	downstreamCalls := 0
+	next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		downstreamCalls++
+		_, _ = rw.Write([]byte(`{"response":"ok"}`))
+	})
+	middleware := newHandler(t, cfg, next).(*dashmiddleware.DashMiddleware)
+
+	err := middleware.Warm(context.Background(), []dashmiddleware.WarmRequest{
+		{URL: "http://localhost/app/_dash-update-component", Body: `{"input":1}`, Email: "warm@example.com"},
+		{URL: "http://localhost/app/_dash-update-component", Body: `{"input":2}`, Email: "warm@example.com", Referer: "https://localhost/app/?frame=frame1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks := backend.Calls("/track")
+	if len(tracks) != 2 || downstreamCalls != 2 {
+		t.Fatalf("expected warming to run downstream and track twice, got %d downstream and %d track calls", downstreamCalls, len(tracks))
+	}
+	if frame := tracks[1].Payload["Frame"]; frame != "frame1" {
+		t.Errorf("expected the warm referer to name the frame, got %v", frame)
+	}
+
+	// Client requests are still checked
+	recorder := httptest.NewRecorder()
+	middleware.ServeHTTP(recorder, newCallbackRequest(`{"input":3}`))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expected a client request without an allowed referer to be rejected, got status %d", recorder.Code)
+	}
+}
+
+func TestIncludeReferer(t *testing.T) {
+	for _, includeReferer := range []bool{false, true} {
+		backend := newStubBackend(t)
+		cfg := backend.config()
+		cfg.IncludeReferer = includeReferer
+		cfg.RefererRedactPattern = `^token$`
+		handler := newHandler(t, cfg, nil)
+
+		req := newCallbackRequest(`{"input":1}`)
+		req.Header.Set("Referer", "https://localhost/app/?frame=frame1&token=secret")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		tracks := backend.Calls("/track")
+		if len(tracks) != 1 {
+			t.Fatalf("expected one track call, got %d", len(tracks))
+		}
+		referer, found := tracks[0].Payload["Referer"]
+		if !includeReferer {
+			if found {
+				t.Errorf("expected no referer when disabled, got %v", referer)
+			}
+			continue
+		}
+		if referer != "https://localhost/app/?frame=frame1&token=REDACTED" {
+			t.Errorf("expected the redacted referer, got %v", referer)
+		}
+	}
+}
+
+func TestTrackEveryN(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.TrackEveryN = 3
+	handler := newHandler(t, cfg, nil)
+
+	var tracked []int
+	for i := 1; i <= 7; i++ {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+		if recorder.Body.String() != `{"response":"ok"}` {
+			t.Errorf("expected request %d to be served normally, got %q", i, recorder.Body.String())
+		}
+		if len(backend.Calls("/track")) > len(tracked) {
+			tracked = append(tracked, i)
+		}
+	}
+
+	if !reflect.DeepEqual(tracked, []int{3, 6}) {
+		t.Errorf("expected the 3rd and 6th request to be tracked, got %v", tracked)
+	}
+}
+
+func TestDebugCacheKeyHeader(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.DebugCacheKeyHeader = "X-Dashpool-Cache-Key"
+	handler := newHandler(t, cfg, nil)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+	hash := sha256.Sum256([]byte("http://localhost/app/_dash-update-component\x00{\"input\":1}"))
+	expected := hex.EncodeToString(hash[:])
+	if got := recorder.Header().Get("X-Dashpool-Cache-Key"); got != expected {
+		t.Errorf("expected cache key %q, got %q", expected, got)
+	}
+
+	lookups := backend.Calls("/result")
+	if len(lookups) != 1 || lookups[0].Payload["Key"] != expected {
+		t.Errorf("expected the result lookup to carry the same key, got %v", lookups)
+	}
+}
+
+func TestLayoutPreflight(t *testing.T) {
+	for _, corsAllowOrigins := range [][]string{nil, {"https://embedding.example.com"}} {
+		backend := newStubBackend(t)
+		cfg := backend.config()
+		cfg.CORSAllowOrigins = corsAllowOrigins
+		downstreamCalls := 0
+		next := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			downstreamCalls++
+			rw.WriteHeader(http.StatusOK)
+		})
+		handler := newHandler(t, cfg, next)
+
+		req := httptest.NewRequest(http.MethodOptions, "http://localhost/app/_dash-layout", http.NoBody)
+		req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+		req.Header.Set("Origin", "https://embedding.example.com")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if n := len(backend.Calls("/getlayout")); n != 0 {
+			t.Errorf("expected no layout backend call for a preflight, got %d", n)
+		}
+		if n := len(backend.Calls("/result")) + len(backend.Calls("/track")); n != 0 {
+			t.Errorf("expected a preflight not to be recorded, got %d backend calls", n)
+		}
+
+		if corsAllowOrigins == nil {
+			if downstreamCalls != 1 {
+				t.Errorf("expected the preflight to be passed downstream without CORS handling, got %d calls", downstreamCalls)
+			}
+			continue
+		}
+		if recorder.Code != http.StatusNoContent || downstreamCalls != 0 {
+			t.Errorf("expected the preflight to be answered by the middleware, got %d and %d downstream calls", recorder.Code, downstreamCalls)
+		}
+		if got := recorder.Header().Get("Access-Control-Allow-Origin"); got != "https://embedding.example.com" {
+			t.Errorf("unexpected allowed origin %q", got)
+		}
+
+		// The layout itself must be readable by the embedding page too
+		for origin, expected := range map[string]string{"https://embedding.example.com": "https://embedding.example.com", "https://other.example.com": ""} {
+			req = httptest.NewRequest(http.MethodPost, "http://localhost/app/_dash-layout", http.NoBody)
+			req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+			req.Header.Set("Origin", origin)
+			recorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			if got := recorder.Header().Get("Access-Control-Allow-Origin"); got != expected {
+				t.Errorf("expected the layout of %s to allow %q, got %q", origin, expected, got)
+			}
+			if got := recorder.Header().Get("Vary"); expected != "" && got != "Origin" {
+				t.Errorf("expected the layout to vary by Origin, got %q", got)
+			}
+		}
+		if n := len(backend.Calls("/getlayout")); n != 2 {
+			t.Errorf("expected the layouts to be served from the backend, got %d calls", n)
+		}
+	}
+}
+
+func TestEmailHasher(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.layout = cachedResult(`{"layout":"ok"}`)
+	cfg := backend.config()
+	cfg.EmailHasher = "hmac-sha256"
+	cfg.EmailHashSecret = "secret"
+	handler := newHandler(t, cfg, nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+	req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+	req.Header.Set("X-Auth-Request-Email", "user@example.com")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("user@example.com"))
+	expected := []interface{}{hex.EncodeToString(mac.Sum(nil))}
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 || !reflect.DeepEqual(tracks[0].Payload["Email"], expected) {
+		t.Errorf("expected the tracked email to be the HMAC, got %v", tracks)
+	}
+	layouts := backend.Calls("/getlayout")
+	if len(layouts) != 1 || !reflect.DeepEqual(layouts[0].Payload["email"], []interface{}{"user@example.com"}) {
+		t.Errorf("expected the layout request to keep the real email, got %v", layouts)
+	}
+}
+
+func TestEmailHasherRequiresSecret(t *testing.T) {
+	cfg := dashmiddleware.CreateConfig()
+	cfg.EmailHasher = "hmac-sha256"
+
+	if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatal("expected an error for a missing secret")
+	}
+}
+
+func TestTimeoutStage(t *testing.T) {
+	t.Run("result lookup", func(t *testing.T) {
+		backend := newStubBackend(t)
+		backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			rw.WriteHeader(http.StatusNotFound)
+		}
+		cfg := backend.config()
+		cfg.ResultLookupTimeout = "20ms"
+		cfg.OnResultTimeout = "fail-closed"
+		downstreamCalls := 0
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			downstreamCalls++
+		}))
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+		if recorder.Code != http.StatusGatewayTimeout || downstreamCalls != 0 {
+			t.Errorf("expected a 504 without downstream call, got %d and %d downstream calls", recorder.Code, downstreamCalls)
+		}
+		tracks := backend.Calls("/track")
+		if len(tracks) != 1 || tracks[0].Payload["TimeoutStage"] != "resultLookup" {
+			t.Errorf("expected the result lookup timeout to be tracked, got %v", tracks)
+		}
+	})
+
+	t.Run("downstream", func(t *testing.T) {
+		backend := newStubBackend(t)
+		cfg := backend.config()
+		cfg.DownstreamTimeout = "20ms"
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(200 * time.Millisecond):
+			}
+			_, _ = rw.Write([]byte(`{"response":"late"}`))
+		}))
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+		if recorder.Code != http.StatusGatewayTimeout || strings.Contains(recorder.Body.String(), "late") {
+			t.Errorf("expected a clean 504, got %d %q", recorder.Code, recorder.Body.String())
+		}
+		tracks := backend.Calls("/track")
+		if len(tracks) != 1 || tracks[0].Payload["TimeoutStage"] != "downstream" {
+			t.Fatalf("expected the downstream timeout to be tracked, got %v", tracks)
+		}
+		if got := tracks[0].Payload["Result"]; got != "" {
+			t.Errorf("expected no result for a timed out request, got %v", got)
+		}
+	})
+
+	t.Run("request", func(t *testing.T) {
+		backend := newStubBackend(t)
+		backend.result = func(rw http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(time.Second):
+			}
+			rw.WriteHeader(http.StatusNotFound)
+		}
+		cfg := backend.config()
+		cfg.RequestTimeout = "20ms"
+		cfg.ResultLookupTimeout = "1s"
+		downstreamCalls := 0
+		handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			downstreamCalls++
+		}))
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+		// Even though a slow result lookup is a miss by default
+		if recorder.Code != http.StatusGatewayTimeout || downstreamCalls != 0 {
+			t.Errorf("expected a 504 without downstream call, got %d and %d downstream calls", recorder.Code, downstreamCalls)
+		}
+		tracks := backend.Calls("/track")
+		if len(tracks) != 1 || tracks[0].Payload["TimeoutStage"] != "request" {
+			t.Errorf("expected the request timeout to be tracked, got %v", tracks)
+		}
+	})
+
+	t.Run("layout", func(t *testing.T) {
+		backend := newStubBackend(t)
+		backend.layout = func(rw http.ResponseWriter, req *http.Request) {
+			<-req.Context().Done()
+		}
+		cfg := backend.config()
+		cfg.LayoutTimeout = "20ms"
+		handler := newHandler(t, cfg, nil)
+		middleware := handler.(*dashmiddleware.DashMiddleware)
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+		req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusGatewayTimeout {
+			t.Errorf("expected a 504, got %d %q", recorder.Code, recorder.Body.String())
+		}
+		if n := middleware.Counter("dashmiddleware_timeouts_total", "stage", "layout"); n != 1 {
+			t.Errorf("expected the layout timeout to be counted, got %d", n)
+		}
+	})
+
+	t.Run("layout request", func(t *testing.T) {
+		backend := newStubBackend(t)
+		backend.layout = func(rw http.ResponseWriter, req *http.Request) {
+			<-req.Context().Done()
+		}
+		cfg := backend.config()
+		cfg.RequestTimeout = "20ms"
+		cfg.LayoutTimeout = "1s"
+		handler := newHandler(t, cfg, nil)
+		middleware := handler.(*dashmiddleware.DashMiddleware)
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+		req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusGatewayTimeout {
+			t.Errorf("expected a 504, got %d %q", recorder.Code, recorder.Body.String())
+		}
+		if n := middleware.Counter("dashmiddleware_timeouts_total", "stage", "request"); n != 1 {
+			t.Errorf("expected the request timeout to be counted, got %d", n)
+		}
+	})
+
+	t.Run("in time", func(t *testing.T) {
+		backend := newStubBackend(t)
+		cfg := backend.config()
+		cfg.DownstreamTimeout = "1s"
+		handler := newHandler(t, cfg, nil)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+		if recorder.Code != http.StatusOK || recorder.Body.String() != `{"response":"ok"}` {
+			t.Errorf("unexpected response %d %q", recorder.Code, recorder.Body.String())
+		}
+		if tracks := backend.Calls("/track"); len(tracks) != 1 || tracks[0].Payload["TimeoutStage"] != nil {
+			t.Errorf("expected a regular track call, got %v", tracks)
+		}
+	})
+}
+
+func TestMaxCookies(t *testing.T) {
+	var cookies []string
+	for i := 0; i < 100; i++ {
+		cookies = append(cookies, fmt.Sprintf("cookie%d=value%d", i, i))
+	}
+	cookieHeader := strings.Join(cookies, "; ")
+
+	for _, tooManyCookies := range []string{"truncate", "reject"} {
+		t.Run(tooManyCookies, func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.MaxCookies = 10
+			cfg.TooManyCookies = tooManyCookies
+			var forwarded []*http.Cookie
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req.Cookies()
+			}))
+
+			req := newCallbackRequest(`{"input":1}`)
+			req.Header.Set("Cookie", cookieHeader)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if tooManyCookies == "reject" {
+				if recorder.Code != http.StatusBadRequest || forwarded != nil {
+					t.Errorf("expected the request to be rejected, got %d", recorder.Code)
+				}
+				return
+			}
+			if recorder.Code != http.StatusOK || len(forwarded) != 10 {
+				t.Errorf("expected 10 forwarded cookies, got %d and status %d", len(forwarded), recorder.Code)
+			}
+		})
+	}
+}
+
+func TestNewStandalone(t *testing.T) {
+	backend := newStubBackend(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		_, _ = rw.Write([]byte(`{"upstream":` + string(body) + `}`))
+	}))
+	defer upstream.Close()
+
+	handler, err := dashmiddleware.NewStandalone(upstream.URL, backend.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+
+	resp, err := http.Post(proxy.URL+"/app/_dash-update-component", "application/json", strings.NewReader(`{"input":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if string(body) != `{"upstream":{"input":1}}` {
+		t.Errorf("unexpected proxied response %q", body)
+	}
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 || tracks[0].Payload["Result"] != `{"upstream":{"input":1}}` {
+		t.Errorf("expected the proxied response to be tracked, got %v", tracks)
+	}
+
+	if _, err := dashmiddleware.NewStandalone("localhost:8050", backend.config()); err == nil {
+		t.Error("expected an error for an upstream without scheme")
+	}
+}
+
+func TestTrackExpiresHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		expires  string
+		expected []string
+	}{
+		{name: "missing"},
+		{name: "malformed", expires: "tomorrow"},
+		{name: "valid", expires: "Wed, 21 Oct 2026 07:28:00 GMT", expected: []string{"Wed, 21 Oct 2026 07:28:00 GMT"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			handler := newHandler(t, backend.config(), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				if tc.expires != "" {
+					rw.Header().Set("Expires", tc.expires)
+				}
+				_, _ = rw.Write([]byte(`{"response":"ok"}`))
+			}))
+
+			handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			if got := tracks[0].Header.Values("Expires"); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("unexpected Expires header %q", got)
+			}
+		})
+	}
+}
+
+func TestCaptureMode(t *testing.T) {
+	for _, captureMode := range []string{"full", "headers", "metadata"} {
+		t.Run(captureMode, func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.CaptureMode = captureMode
+			var capturing *dashmiddleware.CapturingResponseWriter
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				capturing, _ = rw.(*dashmiddleware.CapturingResponseWriter)
+				rw.Header().Set("Content-Type", "application/json")
+				rw.Header().Set("Set-Cookie", "session=secret")
+				rw.WriteHeader(http.StatusCreated)
+				_, _ = rw.Write([]byte(`{"response":"ok"}`))
+			}))
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+			if recorder.Code != http.StatusCreated || recorder.Body.String() != `{"response":"ok"}` {
+				t.Errorf("expected the client to get the full response, got %d %q", recorder.Code, recorder.Body.String())
+			}
+			if capturing == nil {
+				t.Fatal("expected the downstream to write to the capturing writer")
+			}
+
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			payload := tracks[0].Payload
+			_, hasResult := payload["Result"]
+			_, hasHeaders := payload["Headers"]
+
+			switch captureMode {
+			case "full":
+				if !hasResult || len(capturing.Body) == 0 {
+					t.Error("expected the body to be captured")
+				}
+			case "headers":
+				if hasResult || len(capturing.Body) != 0 {
+					t.Error("expected the body not to be captured")
+				}
+				if !hasHeaders || payload["StatusCode"] != float64(http.StatusCreated) {
+					t.Errorf("expected status and headers to be captured, got %v", payload)
+				}
+				headers, _ := payload["Headers"].(map[string]interface{})
+				if got := fmt.Sprint(headers["Set-Cookie"]); got != "[REDACTED]" {
+					t.Errorf("expected the session cookie to be redacted, got %s", got)
+				}
+				if recorder.Header().Get("Set-Cookie") != "session=secret" {
+					t.Errorf("expected the client to get the cookie, got %q", recorder.Header().Get("Set-Cookie"))
+				}
+			case "metadata":
+				if hasResult || hasHeaders || len(capturing.Body) != 0 {
+					t.Errorf("expected neither body nor headers to be captured, got %v", payload)
+				}
+			}
+		})
+	}
+}
+
+func TestTrackIdempotencyKey(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.track = func(rw http.ResponseWriter, _ *http.Request) {
+		if len(backend.Calls("/track")) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+	cfg := backend.config()
+	cfg.TrackRetries = 5
+	handler := newHandler(t, cfg, nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 4 {
+		t.Fatalf("expected two failed attempts, a successful retry and a second event, got %d calls", len(tracks))
+	}
+	key := tracks[0].Header.Get("Idempotency-Key")
+	if key == "" {
+		t.Fatal("expected an idempotency key")
+	}
+	for i, track := range tracks[:3] {
+		if got := track.Header.Get("Idempotency-Key"); got != key {
+			t.Errorf("expected attempt %d to carry key %q, got %q", i+1, key, got)
+		}
+	}
+	if tracks[3].Header.Get("Idempotency-Key") == key {
+		t.Error("expected a new event to get a new idempotency key")
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.MaxConcurrentRecorded = 1
+	cfg.BackpressureMode = "reject"
+	cfg.BackpressureRetryAfter = 5
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-unblock
+		_, _ = rw.Write([]byte(`{"response":"ok"}`))
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+	}()
+	<-started
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":2}`))
+	close(unblock)
+	<-done
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a 429 under saturation, got %d", recorder.Code)
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("expected Retry-After 5, got %q", got)
+	}
+}
+
+func TestTrackAfterFailingStep(t *testing.T) {
+	backend := newStubBackend(t)
+	handler := newHandler(t, backend.config(), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Encoding", "gzip")
+		_, _ = rw.Write([]byte("not gzip"))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 {
+		t.Fatalf("expected the served response to be tracked, got %d calls", len(tracks))
+	}
+	if _, found := tracks[0].Payload["ResultError"]; !found {
+		t.Error("expected the failed decompression to be reported")
+	}
+}
+
+func TestGroupRateLimits(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.RateLimit = 1
+	cfg.GroupRateLimits = map[string]float64{"standard": 2, "premium": 5}
+	handler := newHandler(t, cfg, nil)
+
+	served := func(email, groups string) int {
+		count := 0
+		for i := 0; i < 10; i++ {
+			req := newCallbackRequest(`{"input":1}`)
+			req.Header.Set("X-Auth-Request-Email", email)
+			if groups != "" {
+				req.Header.Set("X-Auth-Request-Groups", groups)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			if recorder.Code == http.StatusOK {
+				count++
+			} else if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+				t.Fatalf("unexpected response %d", recorder.Code)
+			}
+		}
+		return count
+	}
+
+	if n := served("default@example.com", ""); n != 1 {
+		t.Errorf("expected the default limit to allow 1 request, got %d", n)
+	}
+	if n := served("premium@example.com", "standard,premium"); n != 5 {
+		t.Errorf("expected the most permissive group limit to allow 5 requests, got %d", n)
+	}
+}
+
+func TestFormBodyTracking(t *testing.T) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	_ = writer.WriteField("component", "upload")
+	file, _ := writer.CreateFormFile("contents", "data.csv")
+	_, _ = file.Write([]byte("a,b,c\n1,2,3\n"))
+	_ = writer.Close()
+
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.FormBodyTracking = "metadata"
+	var forwarded []byte
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded, _ = io.ReadAll(req.Body)
+	}))
+
+	req := newCallbackRequest(body.String())
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !bytes.Equal(forwarded, body.Bytes()) {
+		t.Error("expected the raw body to be forwarded downstream")
+	}
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track call, got %d", len(tracks))
+	}
+	if got := tracks[0].Payload["Request"]; got != "" {
+		t.Errorf("expected the raw body not to be tracked, got %v", got)
+	}
+	expected := []interface{}{
+		map[string]interface{}{"name": "component", "size": float64(6)},
+		map[string]interface{}{"name": "contents", "filename": "data.csv", "size": float64(12)},
+	}
+	if got := tracks[0].Payload["RequestForm"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected form metadata %v", got)
+	}
+}
+
+func TestCacheIdempotentOnly(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		method    string
+		url       string
+		cacheable bool
+	}{
+		{name: "get", method: http.MethodGet, url: "http://localhost/app/_dash-update-component", cacheable: true},
+		{name: "listed post", method: http.MethodPost, url: "http://localhost/app/_dash-layout", cacheable: true},
+		{name: "post", method: http.MethodPost, url: "http://localhost/app/_dash-update-component"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.CacheIdempotentOnly = true
+			cfg.IdempotentURLs = []string{"/_dash-layout"}
+			handler := newHandler(t, cfg, nil)
+
+			req := httptest.NewRequest(tc.method, tc.url, strings.NewReader(`{"input":1}`))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			lookups := backend.Calls("/result")
+			if tc.cacheable != (len(lookups) == 1) {
+				t.Errorf("expected cacheable %v, got %d result lookups", tc.cacheable, len(lookups))
+			}
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected the request to be tracked, got %d calls", len(tracks))
+			}
+			if got := tracks[0].Payload["Cacheable"]; got != tc.cacheable {
+				t.Errorf("expected Cacheable %v, got %v", tc.cacheable, got)
+			}
+		})
+	}
+}
+
+func TestCacheCountersByPattern(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.result = func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if !strings.Contains(string(body), "_dash-layout") {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		cachedResult(`{"layout":"cached"}`)(rw, req)
+	}
+	middleware := newHandler(t, backend.config(), nil).(*dashmiddleware.DashMiddleware)
+
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody))
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody))
+	middleware.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	for _, tc := range []struct {
+		name     string
+		pattern  string
+		expected int64
+	}{
+		{name: "dashmiddleware_cache_hits_total", pattern: "/_dash-layout", expected: 2},
+		{name: "dashmiddleware_cache_misses_total", pattern: "/_dash-layout", expected: 0},
+		{name: "dashmiddleware_cache_hits_total", pattern: "/_dash-update-component", expected: 0},
+		{name: "dashmiddleware_cache_misses_total", pattern: "/_dash-update-component", expected: 1},
+	} {
+		if got := middleware.Counter(tc.name, "pattern", tc.pattern); got != tc.expected {
+			t.Errorf("expected %s for %s to be %d, got %d", tc.name, tc.pattern, tc.expected, got)
+		}
+	}
+}
+
+func TestInjectCacheMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cached   string
+		expected string
+	}{
+		{name: "object", cached: `{"response":"cached"}`, expected: `{"response":"cached","_dashpool":{"cached":true,"age":42}}`},
+		{name: "array", cached: `["cached"]`, expected: `["cached"]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			backend.result = func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Age", "42")
+				cachedResult(tc.cached)(rw, req)
+			}
+			cfg := backend.config()
+			cfg.InjectCacheMetadata = true
+			handler := newHandler(t, cfg, nil)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+			if got := recorder.Body.String(); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 || tracks[0].Payload["Result"] != tc.cached {
+				t.Errorf("expected the original result to be tracked, got %v", tracks)
+			}
+		})
+	}
+}
+
+func TestLongCallbackDeduplication(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		rw.WriteHeader(http.StatusNotFound)
+	}
+	cfg := backend.config()
+	cfg.LongCallbackDedupWindow = "1m"
+	handler := newHandler(t, cfg, nil)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := newCallbackRequest(`{"input":1}`)
+			req.Header.Set("X-Longcallback", "1")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			codes[i] = recorder.Code
+		}(i)
+	}
+	wg.Wait()
+
+	// The duplicate is looked up without queuing the job again
+	submissions := func() int {
+		n := 0
+		for _, call := range backend.Calls("/result") {
+			if call.Payload["longcallback"] == true {
+				n++
+			}
+		}
+		return n
+	}
+
+	if !reflect.DeepEqual(codes, []int{http.StatusAccepted, http.StatusAccepted}) {
+		t.Errorf("expected both submissions to be accepted, got %v", codes)
+	}
+	if n := submissions(); n != 1 {
+		t.Errorf("expected one backend submission, got %d", n)
+	}
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("X-Longcallback", "1")
+	req.Header.Set("X-Auth-Request-Email", "other@example.com")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if n := submissions(); n != 2 {
+		t.Errorf("expected another user to submit its own long callback, got %d submissions", n)
+	}
+}
+
+func TestLongCallbackDeduplicationFinished(t *testing.T) {
+	backend := newStubBackend(t)
+	var finished int64
+	backend.result = func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt64(&finished) == 0 {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		cachedResult(`{"response":"finished"}`)(rw, req)
+	}
+	cfg := backend.config()
+	cfg.LongCallbackDedupWindow = "1m"
+	handler := newHandler(t, cfg, nil)
+
+	submit := func() *httptest.ResponseRecorder {
+		req := newCallbackRequest(`{"input":1}`)
+		req.Header.Set("X-Longcallback", "1")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	if recorder := submit(); recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected the submission to be accepted, got %d", recorder.Code)
+	}
+	atomic.StoreInt64(&finished, 1)
+
+	recorder := submit()
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"response":"finished"}` {
+		t.Errorf("expected the finished result within the dedup window, got %d %q", recorder.Code, recorder.Body.String())
+	}
+	if n := len(backend.Calls("/result")); n != 2 {
+		t.Errorf("expected the resubmission to be looked up, got %d lookups", n)
+	}
+}
+
+func TestLongCallbackPolling(t *testing.T) {
+	newPollingHandler := func(t *testing.T, backend *stubBackend) http.Handler {
+		cfg := backend.config()
+		cfg.PollPath = "/dashmiddleware/poll"
+		cfg.PollURL = backend.URL + "/poll"
+		cfg.LongCallbackDedupWindow = "1m"
+		return newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			t.Error("expected the long callback not to reach the app")
+		}))
+	}
+	submit := func(handler http.Handler) *httptest.ResponseRecorder {
+		req := newCallbackRequest(`{"input":1}`)
+		req.Header.Set("X-Longcallback", "1")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	poll := func(handler http.Handler, location string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost"+location, http.NoBody))
+		return recorder
+	}
+
+	t.Run("pending then complete", func(t *testing.T) {
+		backend := newStubBackend(t)
+		pending := true
+		backend.poll = func(rw http.ResponseWriter, _ *http.Request) {
+			if pending {
+				pending = false
+				rw.WriteHeader(http.StatusAccepted)
+				return
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			_, _ = rw.Write([]byte(`{"response":"done"}`))
+		}
+		handler := newPollingHandler(t, backend)
+
+		recorder := submit(handler)
+		location := recorder.Header().Get("Location")
+		if recorder.Code != http.StatusAccepted || !strings.HasPrefix(location, "/dashmiddleware/poll?job=") {
+			t.Fatalf("expected a 202 with the poll location, got %d %q", recorder.Code, location)
+		}
+		jobID := strings.TrimPrefix(location, "/dashmiddleware/poll?job=")
+		if lookups := backend.Calls("/result"); len(lookups) != 1 || lookups[0].Payload["JobID"] != jobID {
+			t.Errorf("expected the lookup to name the job %q, got %v", jobID, lookups)
+		}
+		if again := submit(handler); again.Header().Get("Location") != location {
+			t.Errorf("expected a duplicate submission to get the pending job, got %q", again.Header().Get("Location"))
+		}
+
+		accepted := poll(handler, location)
+		if accepted.Code != http.StatusAccepted || accepted.Header().Get("Location") != location {
+			t.Errorf("expected the pending job to be accepted, got %d %q", accepted.Code, accepted.Header().Get("Location"))
+		}
+		done := poll(handler, location)
+		if done.Code != http.StatusOK || done.Body.String() != `{"response":"done"}` || done.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("expected the result of the job, got %d %q", done.Code, done.Body.String())
+		}
+		polled := backend.Calls("/poll")
+		if len(polled) != 2 || polled[0].Payload["JobID"] != jobID {
+			t.Errorf("expected two polls of the job %q, got %v", jobID, polled)
+		}
+	})
+
+	t.Run("backend job ID", func(t *testing.T) {
+		backend := newStubBackend(t)
+		backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+			rw.Header().Set("X-Job-Id", "job-7")
+			rw.WriteHeader(http.StatusNotFound)
+		}
+		handler := newPollingHandler(t, backend)
+
+		if location := submit(handler).Header().Get("Location"); location != "/dashmiddleware/poll?job=job-7" {
+			t.Errorf("expected the job ID of the backend, got %q", location)
+		}
+	})
+
+	t.Run("unknown job", func(t *testing.T) {
+		backend := newStubBackend(t)
+		backend.poll = func(rw http.ResponseWriter, _ *http.Request) {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+		handler := newPollingHandler(t, backend)
+
+		if recorder := poll(handler, "/dashmiddleware/poll?job=missing"); recorder.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", recorder.Code)
+		}
+		if recorder := poll(handler, "/dashmiddleware/poll"); recorder.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 without a job, got %d", recorder.Code)
+		}
+	})
+}
+
+func TestObserveOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		tracked bool
+	}{
+		{name: "cached result", request: func() *http.Request {
+			return newCallbackRequest(`{"input":1}`)
+		}, tracked: true},
+		{name: "long callback", request: func() *http.Request {
+			req := newCallbackRequest(`{"input":1}`)
+			req.Header.Set("X-Longcallback", "1")
+			return req
+		}, tracked: true},
+		{name: "denied group", request: func() *http.Request {
+			req := newCallbackRequest(`{"input":1}`)
+			req.Header.Set("X-Auth-Request-Groups", "contractors")
+			return req
+		}, tracked: true},
+		{name: "layout", request: func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+			req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+			return req
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			backend.result = cachedResult(`{"response":"cached"}`)
+			backend.layout = cachedResult(`{"layout":"ok"}`)
+			cfg := backend.config()
+			cfg.ObserveOnly = true
+			cfg.DeniedGroups = []string{"contractors"}
+			cfg.RecordedURLs = []string{"/_dash-update-component"}
+			downstream := 0
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				downstream++
+				_, _ = rw.Write([]byte(`{"response":"app"}`))
+			}))
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, test.request())
+
+			if downstream != 1 || recorder.Code != http.StatusOK || recorder.Body.String() != `{"response":"app"}` {
+				t.Errorf("expected the app to answer, got %d calls and %d %q", downstream, recorder.Code, recorder.Body.String())
+			}
+			if n := len(backend.Calls("/result")) + len(backend.Calls("/getlayout")); n != 0 {
+				t.Errorf("expected no result or layout lookup, got %d", n)
+			}
+			if tracks := backend.Calls("/track"); test.tracked && (len(tracks) != 1 || tracks[0].Payload["Result"] != `{"response":"app"}`) {
+				t.Errorf("expected the response of the app to be tracked, got %v", tracks)
+			}
+		})
+	}
+}
+
+func TestLookupMethodAndQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []string
+		query  string
+	}{
+		{name: "full query", query: "b=2&a=1&utm=x"},
+		{name: "selected params", params: []string{"a", "b"}, query: "a=1&b=2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.RecordedURLMatch = "exact"
+			cfg.LookupQueryParams = test.params
+			handler := newHandler(t, cfg, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/_dash-update-component?b=2&a=1&utm=x", http.NoBody)
+			req.Header.Set("Referer", "https://localhost/app/?frame=frame1")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			lookups := backend.Calls("/result")
+			if len(lookups) != 1 {
+				t.Fatalf("expected one lookup, got %d", len(lookups))
+			}
+			payload := lookups[0].Payload
+			if payload["Method"] != http.MethodGet || payload["Query"] != test.query {
+				t.Errorf("expected method GET and query %q, got %v and %v", test.query, payload["Method"], payload["Query"])
+			}
+			for _, field := range []string{"Request", "URL", "Key", "longcallback"} {
+				if _, ok := payload[field]; !ok {
+					t.Errorf("expected the lookup to keep %s", field)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyMethodAndQuery(t *testing.T) {
+	newRequest := func(method, query string) *http.Request {
+		req := httptest.NewRequest(method, "http://localhost/_dash-update-component?"+query, strings.NewReader(`{"input":1}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Referer", "https://localhost/app/?frame=frame1")
+		return req
+	}
+
+	t.Run("local cache", func(t *testing.T) {
+		backend := newStubBackend(t)
+		backend.result = cachedResult(`{"response":"cached"}`)
+		cfg := backend.config()
+		cfg.RecordedURLMatch = "exact"
+		cfg.LookupQueryParams = []string{"a"}
+		cfg.LocalCacheMaxBytes = 1 << 20
+		handler := newHandler(t, cfg, nil)
+
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest(http.MethodPost, "a=1&utm=x"))
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest(http.MethodGet, "a=1&utm=x"))
+		lookups := backend.Calls("/result")
+		if len(lookups) != 2 {
+			t.Fatalf("expected a lookup per method, got %d", len(lookups))
+		}
+		if lookups[0].Payload["Key"] == lookups[1].Payload["Key"] {
+			t.Errorf("expected GET and POST to have different keys, got %v", lookups[0].Payload["Key"])
+		}
+
+		// Only the selected params are part of the key
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest(http.MethodGet, "a=1&utm=y"))
+		if n := len(backend.Calls("/result")); n != 2 {
+			t.Errorf("expected other params to hit the local cache, got %d lookups", n)
+		}
+	})
+
+	t.Run("coalesce", func(t *testing.T) {
+		backend := newStubBackend(t)
+		release := make(chan struct{})
+		backend.result = func(rw http.ResponseWriter, req *http.Request) {
+			<-release
+			cachedResult(`{"response":"cached"}`)(rw, req)
+		}
+		cfg := backend.config()
+		cfg.RecordedURLMatch = "exact"
+		cfg.Features = map[string]bool{"coalesce": true}
+		handler := newHandler(t, cfg, nil)
+		middleware := handler.(*dashmiddleware.DashMiddleware)
+
+		var wg sync.WaitGroup
+		for _, method := range []string{http.MethodPost, http.MethodGet} {
+			wg.Add(1)
+			go func(method string) {
+				defer wg.Done()
+				handler.ServeHTTP(httptest.NewRecorder(), newRequest(method, "a=1"))
+			}(method)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for len(backend.Calls("/result")) < 2 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		wg.Wait()
+
+		if n := len(backend.Calls("/result")); n != 2 {
+			t.Errorf("expected a lookup per method, got %d", n)
+		}
+		if n := middleware.Counter("dashmiddleware_lookups_coalesced_total"); n != 0 {
+			t.Errorf("expected GET and POST not to be coalesced, got %d", n)
+		}
+	})
+}
+
+func TestTrackClientAddress(t *testing.T) {
+	tests := []struct {
+		name       string
+		trust      bool
+		forwarded  string
+		realIP     string
+		remoteAddr string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1"},
+		{name: "untrusted chain", forwarded: "203.0.113.7, 198.51.100.2", realIP: "203.0.113.9", remoteAddr: "192.0.2.1"},
+		{name: "trusted chain", trust: true, forwarded: "bogus, 203.0.113.7, 198.51.100.2", remoteAddr: "203.0.113.7"},
+		{name: "trusted real IP", trust: true, realIP: "2001:db8::7", remoteAddr: "2001:db8::7"},
+		{name: "trusted without headers", trust: true, remoteAddr: "192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.TrustForwardedFor = test.trust
+			handler := newHandler(t, cfg, nil)
+
+			req := newCallbackRequest(`{"input":1}`)
+			req.RemoteAddr = "192.0.2.1:54321"
+			req.Header.Set("User-Agent", "dash-test/1.0")
+			if test.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", test.forwarded)
+			}
+			if test.realIP != "" {
+				req.Header.Set("X-Real-IP", test.realIP)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			if got := tracks[0].Payload["RemoteAddr"]; got != test.remoteAddr {
+				t.Errorf("expected RemoteAddr %q, got %v", test.remoteAddr, got)
+			}
+			if got := tracks[0].Payload["UserAgent"]; got != "dash-test/1.0" {
+				t.Errorf("expected the user agent to be tracked, got %v", got)
+			}
+		})
+	}
+}
+
+func TestCacheHeadersAndTrailers(t *testing.T) {
+	setHeaders := func(rw http.ResponseWriter) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Trailer", "X-Checksum")
+	}
+	tests := []struct {
+		name   string
+		cached bool
+	}{
+		{name: "downstream"},
+		{name: "cache hit", cached: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			respond := func(rw http.ResponseWriter, _ *http.Request) {
+				setHeaders(rw)
+				_, _ = rw.Write([]byte(`{"response":"ok"}`))
+				rw.Header().Set("X-Checksum", "abc")
+			}
+			if test.cached {
+				backend.result = respond
+			}
+			handler := newHandler(t, backend.config(), http.HandlerFunc(respond))
+
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			req := newCallbackRequest(`{"input":1}`)
+			clientReq, _ := http.NewRequest(http.MethodPost, server.URL+"/app/_dash-update-component", req.Body)
+			clientReq.Header = req.Header
+			resp, err := http.DefaultClient.Do(clientReq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+
+			if string(body) != `{"response":"ok"}` {
+				t.Errorf("unexpected body %q", body)
+			}
+			if resp.Header.Get("ETag") != `"v1"` || resp.Header.Get("Cache-Control") != "max-age=60" {
+				t.Errorf("expected the cache headers to reach the client, got %v", resp.Header)
+			}
+			if resp.Trailer.Get("X-Checksum") != "abc" {
+				t.Errorf("expected the trailer to reach the client, got %v", resp.Trailer)
+			}
+
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			expected := map[string]interface{}{
+				"CacheHeaders": map[string]interface{}{"ETag": []interface{}{`"v1"`}, "Cache-Control": []interface{}{"max-age=60"}},
+				"Trailers":     map[string]interface{}{"X-Checksum": []interface{}{"abc"}},
+				"Cached":       test.cached,
+			}
+			for field, value := range expected {
+				if got := tracks[0].Payload[field]; !reflect.DeepEqual(got, value) {
+					t.Errorf("expected %s %v, got %v", field, value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSecretsFromEnvironment(t *testing.T) {
+	t.Setenv("DASHPOOL_BACKEND_TOKEN", "env-token")
+	t.Setenv("DASHPOOL_EMAIL_SECRET", "env-secret")
+
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.BackendTokenEnv = "DASHPOOL_BACKEND_TOKEN"
+	cfg.EmailHasher = "hmac-sha256"
+	cfg.EmailHashSecretEnv = "DASHPOOL_EMAIL_SECRET"
+	handler := newHandler(t, cfg, nil)
+
+	if cfg.BackendToken != "env-token" || cfg.EmailHashSecret != "env-secret" {
+		t.Errorf("expected the secrets to be resolved from the environment, got %q and %q", cfg.BackendToken, cfg.EmailHashSecret)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	for _, path := range []string{"/result", "/track"} {
+		calls := backend.Calls(path)
+		if len(calls) != 1 || calls[0].Header.Get("Authorization") != "Bearer env-token" {
+			t.Errorf("expected the %s call to carry the token, got %v", path, calls)
+		}
+	}
+
+	cfg = backend.config()
+	cfg.BackendToken = "configured-token"
+	cfg.BackendTokenEnv = "DASHPOOL_BACKEND_TOKEN"
+	newHandler(t, cfg, nil)
+	if cfg.BackendToken != "configured-token" {
+		t.Errorf("expected a configured value to win over the environment, got %q", cfg.BackendToken)
+	}
+}
+
+func TestStripDownstreamHeaders(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.StripDownstreamHeaders = []string{"X-Auth-Request-*", "x-forwarded-*", "X-Internal"}
+	var forwarded http.Header
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Clone()
+	}))
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("X-Auth-Request-User", "user")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("X-Internal", "1")
+	req.Header.Set("X-Custom", "kept")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, name := range []string{"X-Auth-Request-Email", "X-Auth-Request-User", "X-Forwarded-For", "X-Internal"} {
+		if value := forwarded.Get(name); value != "" {
+			t.Errorf("expected %s to be stripped, got %q", name, value)
+		}
+	}
+	if forwarded.Get("X-Custom") != "kept" {
+		t.Error("expected unlisted headers to be forwarded")
+	}
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 || !reflect.DeepEqual(tracks[0].Payload["Email"], []interface{}{"user@example.com"}) {
+		t.Errorf("expected the stripped email to be tracked, got %v", tracks)
+	}
+}
+
+func TestCaptureClientCert(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.CaptureClientCert = true
+	handler := newHandler(t, cfg, nil)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "reporting-service"}}},
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":2}`))
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 2 {
+		t.Fatalf("expected two track calls, got %d", len(tracks))
+	}
+	if got := tracks[0].Payload["ClientCert"]; got != "reporting-service" {
+		t.Errorf("expected the client certificate CN, got %v", got)
+	}
+	if got, found := tracks[1].Payload["ClientCert"]; found {
+		t.Errorf("expected no client certificate without TLS, got %v", got)
+	}
+}
+
+func TestOnEmptyLayout(t *testing.T) {
+	tests := []struct {
+		mode   string
+		status int
+		body   string
+	}{
+		{mode: "passthrough", status: http.StatusOK, body: " \n"},
+		{mode: "fallback", status: http.StatusOK, body: `{"layout":"fallback"}`},
+		{mode: "error", status: http.StatusBadGateway, body: "the layout layout1 is empty\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			backend := newStubBackend(t)
+			backend.layout = cachedResult(" \n")
+			cfg := backend.config()
+			cfg.OnEmptyLayout = test.mode
+			cfg.FallbackLayout = `{"layout":"fallback"}`
+			handler := newHandler(t, cfg, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+			req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != test.status || recorder.Body.String() != test.body {
+				t.Errorf("expected %d %q, got %d %q", test.status, test.body, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestFallbackLayoutRequiresJSON(t *testing.T) {
+	cfg := dashmiddleware.CreateConfig()
+	cfg.OnEmptyLayout = "fallback"
+	cfg.FallbackLayout = "{"
+
+	if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "dashmiddleware-test"); err == nil {
+		t.Error("expected an error for an invalid fallback layout")
+	}
+}
+
+func TestRequestBytesConsumed(t *testing.T) {
+	backend := newStubBackend(t)
+	handler := newHandler(t, backend.config(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	body := `{"input":"consumed"}`
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(body))
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track call, got %d", len(tracks))
+	}
+	if got := tracks[0].Payload["RequestBytesConsumed"]; got != float64(len(body)) {
+		t.Errorf("expected %d consumed bytes, got %v", len(body), got)
+	}
+}
+
+func TestAllowedRefererHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		referer  string
+		layouts  int
+		callback int
+	}{
+		{name: "allowed", referer: "https://localhost:8443/app/?frame=frame1&layout=layout1", layouts: 1, callback: http.StatusOK},
+		{name: "disallowed", referer: "https://evil.example.com/app/?frame=frame1&layout=layout1", layouts: 0, callback: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			backend.layout = cachedResult(`{"layout":"ok"}`)
+			cfg := backend.config()
+			cfg.AllowedRefererHosts = []string{"localhost"}
+			cfg.RejectDisallowedReferers = true
+			handler := newHandler(t, cfg, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+			req.Header.Set("Referer", test.referer)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if layouts := backend.Calls("/getlayout"); len(layouts) != test.layouts {
+				t.Errorf("expected %d layout calls, got %d", test.layouts, len(layouts))
+			}
+
+			req = newCallbackRequest(`{"input":1}`)
+			req.Header.Set("Referer", test.referer)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != test.callback {
+				t.Errorf("expected status %d, got %d", test.callback, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestGroupAccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		groups  string
+		status  int
+	}{
+		{name: "no lists", groups: "users", status: http.StatusOK},
+		{name: "allowed", allowed: []string{"analysts"}, groups: "users,analysts", status: http.StatusOK},
+		{name: "not allowed", allowed: []string{"analysts"}, groups: "users", status: http.StatusForbidden},
+		{name: "no groups", allowed: []string{"analysts"}, status: http.StatusForbidden},
+		{name: "denied", denied: []string{"contractors"}, groups: "users, contractors", status: http.StatusForbidden},
+		{name: "not denied", denied: []string{"contractors"}, groups: "users", status: http.StatusOK},
+		{name: "deny wins", allowed: []string{"analysts"}, denied: []string{"contractors"}, groups: "analysts,contractors", status: http.StatusForbidden},
+		{name: "allowed and not denied", allowed: []string{"analysts"}, denied: []string{"contractors"}, groups: "analysts", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.AllowedGroups = test.allowed
+			cfg.DeniedGroups = test.denied
+			handler := newHandler(t, cfg, nil)
+
+			req := newCallbackRequest(`{"input":1}`)
+			if test.groups != "" {
+				req.Header.Set("X-Auth-Request-Groups", test.groups)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, recorder.Code)
+			}
+			if test.status == http.StatusForbidden && len(backend.Calls("/result")) != 0 {
+				t.Error("expected no result lookup for a forbidden group")
+			}
+		})
+	}
+
+	t.Run("non-recorded", func(t *testing.T) {
+		backend := newStubBackend(t)
+		cfg := backend.config()
+		cfg.AllowedGroups = []string{"analysts"}
+		handler := newHandler(t, cfg, nil)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost/app/assets/style.css", http.NoBody))
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("expected non-recorded URLs to stay accessible, got %d", recorder.Code)
+		}
+	})
+}
+
+func TestRefererHandling(t *testing.T) {
+	tests := []struct {
+		name        string
+		referer     string
+		frame       string
+		refererBase string
+		required    int
+	}{
+		{name: "absent", required: http.StatusBadRequest},
+		{name: "partial", referer: "https://localhost", required: http.StatusOK},
+		{name: "no query", referer: "https://localhost/app/", required: http.StatusOK},
+		{name: "malformed", referer: "https://local host/app/?frame=frame1", frame: "frame1", refererBase: "/app", required: http.StatusBadRequest},
+		{name: "relative", referer: "/app/?frame=frame1", frame: "frame1", required: http.StatusBadRequest},
+		{name: "valid", referer: "https://localhost/app/?frame=frame1", frame: "frame1", refererBase: "/app", required: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, require := range []bool{false, true} {
+				backend := newStubBackend(t)
+				cfg := backend.config()
+				cfg.RequireReferer = require
+				handler := newHandler(t, cfg, nil)
+
+				req := newCallbackRequest(`{"input":1}`)
+				req.Header.Del("Referer")
+				if test.referer != "" {
+					req.Header.Set("Referer", test.referer)
+				}
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, req)
+
+				expected := http.StatusOK
+				if require {
+					expected = test.required
+				}
+				if recorder.Code != expected {
+					t.Errorf("expected status %d with requirereferer=%v, got %d", expected, require, recorder.Code)
+				}
+				tracks := backend.Calls("/track")
+				if expected != http.StatusOK {
+					if len(tracks) != 0 {
+						t.Errorf("expected a rejected request not to be tracked, got %d tracks", len(tracks))
+					}
+					continue
+				}
+				if len(tracks) != 1 || tracks[0].Payload["Frame"] != test.frame || tracks[0].Payload["RefererBase"] != test.refererBase {
+					t.Errorf("expected frame %q and referer base %q to be tracked, got %v", test.frame, test.refererBase, tracks)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressionRatio(t *testing.T) {
+	result := strings.Repeat(`{"response":"compressible"}`, 100)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write([]byte(result))
+	_ = writer.Close()
+
+	backend := newStubBackend(t)
+	handler := newHandler(t, backend.config(), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Encoding", "gzip")
+		_, _ = rw.Write(compressed.Bytes())
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track call, got %d", len(tracks))
+	}
+	if tracks[0].Payload["Result"] != result {
+		t.Errorf("expected the decompressed result, got %v", tracks[0].Payload["Result"])
+	}
+	expected := float64(compressed.Len()) / float64(len(result))
+	if got := tracks[0].Payload["CompressionRatio"]; got != expected {
+		t.Errorf("expected a compression ratio of %v, got %v", expected, got)
+	}
+}
+
+func TestLayoutURLSuffix(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.layout = cachedResult(`{"layout":"custom"}`)
+	cfg := backend.config()
+	cfg.LayoutURLSuffix = "/_custom-layout"
+	handler := newHandler(t, cfg, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_custom-layout", http.NoBody)
+	req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Body.String() != `{"layout":"custom"}` {
+		t.Errorf("expected the layout from the backend, got %q", recorder.Body.String())
+	}
+	layouts := backend.Calls("/getlayout")
+	if len(layouts) != 1 || layouts[0].Payload["layout"] != "layout1" || layouts[0].Payload["frame"] != "frame1" {
+		t.Errorf("expected one layout call for layout1, got %v", layouts)
+	}
+}
+
+func TestLayoutDisabled(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.layout = cachedResult(`{"layout":"backend"}`)
+	cfg := backend.config()
+	cfg.LayoutEnabled = false
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte(`{"layout":"app"}`))
+	}))
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody),
+		httptest.NewRequest(http.MethodPost, "http://localhost/app/_dash-layout", strings.NewReader(`{"layout":"layout1"}`)),
+	} {
+		req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Body.String() != `{"layout":"app"}` {
+			t.Errorf("expected the app to serve its own layout, got %q", recorder.Body.String())
+		}
+	}
+	if layouts := backend.Calls("/getlayout"); len(layouts) != 0 {
+		t.Errorf("expected no layout backend call, got %d", len(layouts))
+	}
+}
+
+func TestLayoutFromBody(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.layout = cachedResult(`{"layout":"from-body"}`)
+	handler := newHandler(t, backend.config(), nil)
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/app/_dash-layout", strings.NewReader(`{"layout":"layout1","frame":"frame2"}`))
+	req.Header.Set("Referer", "https://localhost/app/")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Body.String() != `{"layout":"from-body"}` {
+		t.Errorf("expected the layout from the backend, got %q", recorder.Body.String())
+	}
+	layouts := backend.Calls("/getlayout")
+	if len(layouts) != 1 || layouts[0].Payload["layout"] != "layout1" || layouts[0].Payload["frame"] != "frame2" {
+		t.Errorf("expected one layout call with the identifiers of the body, got %v", layouts)
+	}
+}
+
+func TestLayoutPassThrough(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		wantType    string
+	}{
+		{name: "not found", status: http.StatusNotFound, contentType: "application/json", body: `{"error":"unknown layout"}`, wantType: "application/json"},
+		{name: "non-JSON", status: http.StatusOK, contentType: "text/html; charset=utf-8", body: "<p>maintenance</p>", wantType: "text/html; charset=utf-8"},
+		{name: "no content type", status: http.StatusOK, body: `{"layout":"ok"}`, wantType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			backend.layout = func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header()["Content-Type"] = nil
+				if tt.contentType != "" {
+					rw.Header().Set("Content-Type", tt.contentType)
+				}
+				rw.WriteHeader(tt.status)
+				_, _ = rw.Write([]byte(tt.body))
+			}
+			handler := newHandler(t, backend.config(), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				t.Error("expected the layout answer not to fall through to the app")
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+			req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.status || recorder.Body.String() != tt.body {
+				t.Errorf("expected %d %q, got %d %q", tt.status, tt.body, recorder.Code, recorder.Body.String())
+			}
+			if got := recorder.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("expected content type %q, got %q", tt.wantType, got)
+			}
+		})
+	}
+}
+
+func TestDecompressRequest(t *testing.T) {
+	body := `{"input":"large"}`
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write([]byte(body))
+	_ = writer.Close()
+
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.DecompressRequest = true
+	var forwarded []byte
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded, _ = io.ReadAll(req.Body)
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	req := newCallbackRequest(compressed.String())
+	req.Header.Set("Content-Encoding", "gzip")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !bytes.Equal(forwarded, compressed.Bytes()) {
+		t.Error("expected the downstream to get the compressed body")
+	}
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 || tracks[0].Payload["Request"] != body {
+		t.Errorf("expected the decompressed request to be tracked, got %v", tracks)
+	}
+}
+
+func TestFeatureCoalesce(t *testing.T) {
+	backend := newStubBackend(t)
+	release := make(chan struct{})
+	backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+		<-release
+		cachedResult(`{"response":"cached"}`)(rw, nil)
+	}
+	cfg := backend.config()
+	cfg.Features = map[string]bool{"coalesce": true}
+	handler := newHandler(t, cfg, nil)
+	middleware := handler.(*dashmiddleware.DashMiddleware)
+
+	var wg sync.WaitGroup
+	recorders := []*httptest.ResponseRecorder{httptest.NewRecorder(), httptest.NewRecorder()}
+	for _, recorder := range recorders {
+		wg.Add(1)
+		go func(recorder *httptest.ResponseRecorder) {
+			defer wg.Done()
+			handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+		}(recorder)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for middleware.Counter("dashmiddleware_lookups_coalesced_total") == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if lookups := backend.Calls("/result"); len(lookups) != 1 {
+		t.Errorf("expected one coalesced lookup, got %d", len(lookups))
+	}
+	for _, recorder := range recorders {
+		if recorder.Body.String() != `{"response":"cached"}` {
+			t.Errorf("expected the cached result, got %q", recorder.Body.String())
+		}
+	}
+}
+
+func TestCoalesceIndependentRequests(t *testing.T) {
+	backend := newStubBackend(t)
+	release := make(chan struct{})
+	backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+		<-release
+		cachedResult(`{"response":"cached"}`)(rw, nil)
+	}
+	cfg := backend.config()
+	cfg.FailOpen = false
+	cfg.Features = map[string]bool{"coalesce": true}
+	handler := newHandler(t, cfg, nil)
+	middleware := handler.(*dashmiddleware.DashMiddleware)
+	waitCoalesced := func(n int64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for middleware.Counter("dashmiddleware_lookups_coalesced_total") < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The client of the first request goes away, the one waiting for its lookup still gets the result
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`).WithContext(leaderCtx))
+	}()
+	waiter := httptest.NewRecorder()
+	waiterDone := make(chan struct{})
+	go func() {
+		defer close(waiterDone)
+		handler.ServeHTTP(waiter, newCallbackRequest(`{"input":1}`))
+	}()
+	waitCoalesced(1)
+	cancelLeader()
+	<-leaderDone
+
+	// A waiter whose own client goes away stops waiting right away
+	impatientCtx, cancelImpatient := context.WithCancel(context.Background())
+	impatientDone := make(chan struct{})
+	go func() {
+		defer close(impatientDone)
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`).WithContext(impatientCtx))
+	}()
+	waitCoalesced(2)
+	cancelImpatient()
+	select {
+	case <-impatientDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a cancelled waiter to stop waiting for the lookup")
+	}
+
+	// Long callbacks queue jobs of their own and are never coalesced
+	long := newCallbackRequest(`{"input":1}`)
+	long.Header.Set("X-Longcallback", "1")
+	longDone := make(chan struct{})
+	go func() {
+		defer close(longDone)
+		handler.ServeHTTP(httptest.NewRecorder(), long)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(backend.Calls("/result")) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	<-waiterDone
+	<-longDone
+
+	if waiter.Code != http.StatusOK || waiter.Body.String() != `{"response":"cached"}` {
+		t.Errorf("expected the waiter to get the cached result, got %d %q", waiter.Code, waiter.Body.String())
+	}
+	if got := middleware.Counter("dashmiddleware_lookups_coalesced_total"); got != 2 {
+		t.Errorf("expected two coalesced lookups, got %d", got)
+	}
+	if lookups := backend.Calls("/result"); len(lookups) != 2 {
+		t.Errorf("expected a shared and a long callback lookup, got %d", len(lookups))
+	}
+}
+
+func TestCacheHitNotChunked(t *testing.T) {
+	result := `{"response":"` + strings.Repeat("cached", 1000) + `"}`
+	backend := newStubBackend(t)
+	backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Transfer-Encoding", "chunked")
+		_, _ = rw.Write([]byte(result))
+	}
+	server := httptest.NewServer(newHandler(t, backend.config(), nil))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/app/_dash-update-component", strings.NewReader(`{"input":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if len(resp.TransferEncoding) != 0 || resp.ContentLength != int64(len(result)) {
+		t.Errorf("expected a Content-Length of %d without chunking, got %d %v", len(result), resp.ContentLength, resp.TransferEncoding)
+	}
+	if string(body) != result {
+		t.Errorf("expected the cached result, got %d bytes", len(body))
+	}
+}
+
+func TestCacheValidation(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.result = cachedResult(`{"response":"stale"}`)
+	cfg := backend.config()
+	cfg.CacheValidationSampleRate = 1
+	handler := newHandler(t, cfg, nil)
+	middleware := handler.(*dashmiddleware.DashMiddleware)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+	if recorder.Body.String() != `{"response":"stale"}` {
+		t.Errorf("expected the client to get the cached result, got %q", recorder.Body.String())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for middleware.Counter("dashmiddleware_cache_validations_total", "pattern", "/_dash-update-component") == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := middleware.Counter("dashmiddleware_cache_validation_mismatches_total", "pattern", "/_dash-update-component"); got != 1 {
+		t.Errorf("expected one mismatch, got %d", got)
+	}
+}
+
+func TestLocalCacheMaxBytes(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.result = func(rw http.ResponseWriter, req *http.Request) {
+		var payload map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&payload)
+		_, _ = rw.Write([]byte(fmt.Sprintf(`{"request":%q,"padding":%q}`, payload["Request"], strings.Repeat("x", 40))))
+	}
+	cfg := backend.config()
+	cfg.LocalCacheMaxBytes = 100
+	handler := newHandler(t, cfg, nil)
+
+	// Each result is about 70 bytes, the second evicts the first
+	for _, body := range []string{`{"input":1}`, `{"input":2}`, `{"input":2}`, `{"input":1}`} {
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(body))
+	}
+
+	lookups := backend.Calls("/result")
+	if len(lookups) != 3 {
+		t.Fatalf("expected the evicted entry to be looked up again, got %d lookups", len(lookups))
+	}
+	if lookups[2].Payload["Request"] != `{"input":1}` {
+		t.Errorf("expected the least recently used entry to be evicted, got %v", lookups[2].Payload["Request"])
+	}
+}
+
+func TestLocalCacheExpiry(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.result = func(rw http.ResponseWriter, req *http.Request) {
+		var payload map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&payload)
+		switch payload["Request"] {
+		case `{"input":1}`:
+			rw.Header().Set("Cache-Control", "max-age=60")
+		case `{"input":2}`:
+			rw.Header().Set("Expires", time.Date(2030, 1, 1, 0, 2, 0, 0, time.UTC).Format(http.TimeFormat))
+		case `{"input":4}`:
+			rw.Header().Set("Cache-Control", "no-store")
+		}
+		_, _ = rw.Write([]byte(`{"response":"cached"}`))
+	}
+	cfg := backend.config()
+	cfg.LocalCacheMaxBytes = 1 << 20
+	cfg.FrameCacheTTL = map[string]string{"frame1": "3m"}
+	handler := newHandler(t, cfg, nil)
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	handler.(*dashmiddleware.DashMiddleware).SetClock(func() time.Time { return now })
+
+	serve := func(body string) {
+		req := newCallbackRequest(body)
+		req.Header.Set("Referer", "https://localhost/app/?frame=frame1")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	lookups := func(body string) int {
+		count := 0
+		for _, call := range backend.Calls("/result") {
+			if call.Payload["Request"] == body {
+				count++
+			}
+		}
+		return count
+	}
+
+	inputs := []string{`{"input":1}`, `{"input":2}`, `{"input":3}`, `{"input":4}`}
+	for _, body := range inputs {
+		serve(body)
+		serve(body)
+	}
+	for i, expected := range []int{1, 1, 1, 2} {
+		if got := lookups(inputs[i]); got != expected {
+			t.Errorf("expected %d lookups of %s before the expiry, got %d", expected, inputs[i], got)
+		}
+	}
+
+	// max-age expires first, then Expires, then the TTL of the frame
+	for i, advance := range []time.Duration{61 * time.Second, time.Minute, time.Minute} {
+		now = now.Add(advance)
+		serve(inputs[i])
+		if got := lookups(inputs[i]); got != 2 {
+			t.Errorf("expected %s to expire after %s, got %d lookups", inputs[i], advance, got)
+		}
+		if i+1 < 3 {
+			serve(inputs[i+1])
+			if got := lookups(inputs[i+1]); got != 1 {
+				t.Errorf("expected %s to still be cached, got %d lookups", inputs[i+1], got)
+			}
+		}
+	}
+}
+
+// failingReader returns some data and then fails, like a client aborting an upload.
+type failingReader struct {
+	sent bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.sent {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.sent = true
+	return copy(p, `{"input":`), nil
+}
+
+func TestRequestBodyReadError(t *testing.T) {
+	backend := newStubBackend(t)
+	called := false
+	handler := newHandler(t, backend.config(), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		called = true
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/app/_dash-update-component", &failingReader{})
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", recorder.Code)
+	}
+	if called {
+		t.Error("expected the partial body not to be forwarded downstream")
+	}
+	if tracks := backend.Calls("/track"); len(tracks) != 0 {
+		t.Errorf("expected no track call, got %d", len(tracks))
+	}
+}
+
+func TestTraefikMetadata(t *testing.T) {
+	backend := newStubBackend(t)
+	handler := newHandler(t, backend.config(), nil)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("X-Traefik-Router", "dash@kubernetescrd")
+	req.Header.Set("X-Traefik-Entrypoint", "websecure")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":2}`))
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 2 {
+		t.Fatalf("expected two track calls, got %d", len(tracks))
+	}
+	expected := map[string]interface{}{"Router": "dash@kubernetescrd", "Entrypoint": "websecure"}
+	if got := tracks[0].Payload["Traefik"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if got, found := tracks[1].Payload["Traefik"]; found {
+		t.Errorf("expected no Traefik metadata without the headers, got %v", got)
+	}
+}
+
+func TestBinaryRequestEncoding(t *testing.T) {
+	backend := newStubBackend(t)
+	handler := newHandler(t, backend.config(), nil)
+
+	body := []byte{0x0a, 0x03, 0xff, 0xfe, 0x00, 0x80}
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(string(body)))
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 2 {
+		t.Fatalf("expected two track calls, got %d", len(tracks))
+	}
+	if tracks[0].Payload["Request"] != base64.StdEncoding.EncodeToString(body) || tracks[0].Payload["RequestEncoding"] != "base64" {
+		t.Errorf("expected a base64 encoded request, got %v %v", tracks[0].Payload["Request"], tracks[0].Payload["RequestEncoding"])
+	}
+	if got, found := tracks[1].Payload["RequestEncoding"]; found {
+		t.Errorf("expected no encoding for a text request, got %v", got)
+	}
+}
+
+func TestLocalCacheSnapshot(t *testing.T) {
+	path := t.TempDir() + "/snapshot.json"
+
+	backend := newStubBackend(t)
+	backend.result = func(rw http.ResponseWriter, req *http.Request) {
+		var payload map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&payload)
+		if payload["Request"] == `{"input":2}` {
+			rw.Header().Set("Expires", "Mon, 01 Jan 2001 00:00:00 GMT")
+		}
+		_, _ = rw.Write([]byte(`{"response":"cached"}`))
+	}
+	cfg := backend.config()
+	cfg.LocalCacheMaxBytes = 1 << 20
+	cfg.LocalCacheSnapshotPath = path
+	handler := newHandler(t, cfg, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":2}`))
+	if err := handler.(*dashmiddleware.DashMiddleware).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newStubBackend(t)
+	cfg.TrackURL = restarted.URL + "/track"
+	cfg.ResultURL = restarted.URL + "/result"
+	handler = newHandler(t, cfg, nil)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+	if recorder.Body.String() != `{"response":"cached"}` {
+		t.Errorf("expected the result from the snapshot, got %q", recorder.Body.String())
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":2}`))
+
+	lookups := restarted.Calls("/result")
+	if len(lookups) != 1 || lookups[0].Payload["Request"] != `{"input":2}` {
+		t.Errorf("expected only the expired entry to be looked up, got %v", lookups)
+	}
+}
+
+func TestCaptureModeHeader(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.CaptureMode = "metadata"
+	cfg.CaptureModeHeader = "X-Debug-Capture"
+	var forwarded string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Get("X-Debug-Capture")
+		_, _ = rw.Write([]byte(`{"response":"ok"}`))
+	}))
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("X-Debug-Capture", "full")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":2}`))
+
+	if forwarded != "" {
+		t.Errorf("expected the capture mode header not to be forwarded, got %q", forwarded)
+	}
+	tracks := backend.Calls("/track")
+	if len(tracks) != 2 {
+		t.Fatalf("expected two track calls, got %d", len(tracks))
+	}
+	if tracks[0].Payload["CaptureMode"] != "full" || tracks[0].Payload["Result"] != `{"response":"ok"}` {
+		t.Errorf("expected the header to upgrade to full capture, got %v", tracks[0].Payload)
+	}
+	if _, found := tracks[1].Payload["Result"]; found || tracks[1].Payload["CaptureMode"] != "metadata" {
+		t.Errorf("expected metadata capture without the header, got %v", tracks[1].Payload)
+	}
+}
+
+func TestOnResultTimeout(t *testing.T) {
+	tests := []struct {
+		mode            string
+		status          int
+		downstreamCalls int
+	}{
+		{mode: "", status: http.StatusOK, downstreamCalls: 1},
+		{mode: "fail-closed", status: http.StatusGatewayTimeout, downstreamCalls: 0},
+		{mode: "miss", status: http.StatusOK, downstreamCalls: 1},
+	}
+
+	for _, test := range tests {
+		name := test.mode
+		if name == "" {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+				rw.WriteHeader(http.StatusNotFound)
+			}
+			cfg := backend.config()
+			cfg.ResultLookupTimeout = "20ms"
+			cfg.OnResultTimeout = test.mode
+			downstreamCalls := 0
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				downstreamCalls++
+			}))
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+			if recorder.Code != test.status || downstreamCalls != test.downstreamCalls {
+				t.Errorf("expected %d with %d downstream calls, got %d and %d", test.status, test.downstreamCalls, recorder.Code, downstreamCalls)
+			}
+			middleware := handler.(*dashmiddleware.DashMiddleware)
+			if got := middleware.Counter("dashmiddleware_result_lookup_timeouts_total", "pattern", "/_dash-update-component"); got != 1 {
+				t.Errorf("expected one result lookup timeout, got %d", got)
+			}
+		})
+	}
+}
+
+func TestFrameLatencyHistogram(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.MetricsMaxFrames = 1
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.Header.Get("Referer"), "slow") {
+			time.Sleep(30 * time.Millisecond)
+		}
+		_, _ = rw.Write([]byte(`{"response":"ok"}`))
+	}))
+
+	for i, frame := range []string{"frame1", "frame1", "slow"} {
+		req := newCallbackRequest(fmt.Sprintf(`{"input":%d}`, i))
+		req.Header.Set("Referer", "https://localhost/app/?frame="+frame)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.(*dashmiddleware.DashMiddleware).MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+
+	for _, expected := range []string{
+		"# TYPE dashmiddleware_request_duration_seconds histogram",
+		`dashmiddleware_request_duration_seconds_bucket{frame="frame1",cached="false",le="+Inf"} 2`,
+		`dashmiddleware_request_duration_seconds_count{frame="frame1",cached="false"} 2`,
+		`dashmiddleware_request_duration_seconds_bucket{frame="other",cached="false",le="0.025"} 0`,
+		`dashmiddleware_request_duration_seconds_count{frame="other",cached="false"} 1`,
+	} {
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("expected %q in the metrics, got\n%s", expected, recorder.Body.String())
+		}
+	}
+}
+
+func TestFrameLabelHostileReferer(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.FrameCacheTTL = map[string]string{`quoted"frame\`: "1m"}
+	handler := newHandler(t, cfg, nil)
+
+	for _, frame := range []string{"a\"} 1\nevil_metric{x=\"", `quoted"frame\`} {
+		req := newCallbackRequest(`{"input":1}`)
+		req.Header.Set("Referer", "https://localhost/app/?frame="+frame)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.(*dashmiddleware.DashMiddleware).MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+
+	if strings.Contains(recorder.Body.String(), "\nevil_metric") {
+		t.Errorf("expected no series injected by the Referer, got\n%s", recorder.Body.String())
+	}
+	for _, expected := range []string{
+		`dashmiddleware_request_duration_seconds_count{frame="other",cached="false"} 1`,
+		`dashmiddleware_request_duration_seconds_count{frame="quoted\"frame\\",cached="false"} 1`,
+	} {
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("expected %q in the metrics, got\n%s", expected, recorder.Body.String())
+		}
+	}
+}
+
+func TestLifecycleDrain(t *testing.T) {
+	path := t.TempDir() + "/snapshot.json"
+	backend := newStubBackend(t)
+	backend.result = cachedResult(`{"response":"cached"}`)
+	cfg := backend.config()
+	cfg.LocalCacheMaxBytes = 1 << 20
+	cfg.LocalCacheSnapshotPath = path
+	cfg.CacheValidationSampleRate = 1
+
+	recomputing := make(chan struct{})
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler, err := dashmiddleware.New(ctx, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		close(recomputing)
+		<-release
+		_, _ = rw.Write([]byte(`{"response":"cached"}`))
+	}), cfg, "dashmiddleware-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := handler.(*dashmiddleware.DashMiddleware)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+	<-recomputing
+	cancel()
+
+	select {
+	case <-middleware.Drained():
+		t.Fatal("expected the drain to wait for the running cache validation")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-middleware.Drained():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the middleware to drain")
+	}
+
+	if got := middleware.Counter("dashmiddleware_cache_validations_total", "pattern", "/_dash-update-component"); got != 1 {
+		t.Errorf("expected the running cache validation to finish, got %d", got)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the local cache snapshot to be written: %v", err)
+	}
+
+	// Nothing is started in the background once draining
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+	if got := middleware.Counter("dashmiddleware_cache_validations_total", "pattern", "/_dash-update-component"); got != 1 {
+		t.Errorf("expected no cache validation after draining, got %d", got)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	hang := func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	backend := newStubBackend(t)
+	backend.layout = hang
+	backend.track = hang
+	cfg := backend.config()
+	cfg.RequestTimeout = "50ms"
+	handler := newHandler(t, cfg, nil)
+
+	start := time.Now()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+	req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the slow backend calls to be aborted, took %v", elapsed)
+	}
+	if layouts, tracks := backend.Calls("/getlayout"), backend.Calls("/track"); len(layouts) != 1 || len(tracks) != 1 {
+		t.Errorf("expected one layout and one track call, got %d and %d", len(layouts), len(tracks))
+	}
+}
+
+func TestCallTimeouts(t *testing.T) {
+	hang := func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+	backend := newStubBackend(t)
+	backend.result = hang
+	backend.layout = hang
+	backend.track = hang
+	cfg := backend.config()
+	cfg.RequestTimeout = "10s"
+	cfg.ResultLookupTimeout = "20ms"
+	cfg.TrackTimeout = "50ms"
+	cfg.LayoutTimeout = "50ms"
+	// The app may take longer than any of the backend calls
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = rw.Write([]byte(`{"response":"app"}`))
+	}))
+
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"response":"app"}` {
+		t.Errorf("expected the slow lookup to be a miss served by the app, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+	req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected the slow layout to be answered with a 504, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the slow backend calls to be aborted by their own timeouts, took %v", elapsed)
+	}
+	if tracks := backend.Calls("/track"); len(tracks) != 1 || tracks[0].Payload["Result"] != `{"response":"app"}` {
+		t.Errorf("expected the response to be tracked despite the lookup timeout, got %v", tracks)
+	}
+}
+
+func TestInvalidRequestTimeout(t *testing.T) {
+	cfg := dashmiddleware.CreateConfig()
+	cfg.RequestTimeout = "ten seconds"
+
+	if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "dashmiddleware-test"); err == nil {
+		t.Error("expected an error for an invalid request timeout")
+	}
+}
+
+func TestBackendURLValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *dashmiddleware.Config)
+		err    string
+	}{
+		{name: "scheme typo", modify: func(cfg *dashmiddleware.Config) { cfg.TrackURL = "htttp://backend/track" }, err: "trackurl"},
+		{name: "empty track", modify: func(cfg *dashmiddleware.Config) { cfg.TrackURL = "" }, err: "trackurl is required"},
+		{name: "relative result", modify: func(cfg *dashmiddleware.Config) { cfg.ResultURL = "/result" }, err: "resulturl"},
+		{name: "empty result", modify: func(cfg *dashmiddleware.Config) { cfg.ResultURL = "" }, err: "resulturl is required"},
+		{name: "missing host", modify: func(cfg *dashmiddleware.Config) { cfg.LayoutURL = "http:///getlayout" }, err: "layouturl"},
+		{name: "empty layout", modify: func(cfg *dashmiddleware.Config) { cfg.LayoutURL = "" }, err: "layoutenabled"},
+		{name: "unparsable poll", modify: func(cfg *dashmiddleware.Config) { cfg.PollURL = "http://backend:port/poll" }, err: "pollurl"},
+		{name: "track route", modify: func(cfg *dashmiddleware.Config) {
+			cfg.TrackRoutes = []dashmiddleware.TrackRoute{{LongCallback: true, TrackURL: "backend/track-long"}}
+		}, err: "trackroutes[0].trackurl"},
+		{name: "layout disabled", modify: func(cfg *dashmiddleware.Config) {
+			cfg.LayoutEnabled = false
+			cfg.LayoutURL = ""
+		}},
+		{name: "observe only", modify: func(cfg *dashmiddleware.Config) {
+			cfg.ObserveOnly = true
+			cfg.ResultURL = ""
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := dashmiddleware.CreateConfig()
+			test.modify(cfg)
+
+			_, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "dashmiddleware-test")
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("expected the config to be valid, got %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("expected an error naming %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestBackendConnectionReuse(t *testing.T) {
+	var mu sync.Mutex
+	connections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+		if strings.HasPrefix(req.URL.Path, "/result") {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			connections++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	cfg := dashmiddleware.CreateConfig()
+	cfg.TrackURL = server.URL + "/track"
+	cfg.ResultURL = server.URL + "/result"
+	cfg.MaxIdleConns = 4
+	handler := newHandler(t, cfg, nil)
+
+	for i := 0; i < 5; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(fmt.Sprintf(`{"input":%d}`, i)))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if connections != 1 {
+		t.Errorf("expected the backend calls to share one connection, got %d", connections)
+	}
+}
+
+func TestVaryKey(t *testing.T) {
+	backend := newStubBackend(t)
+	handler := newHandler(t, backend.config(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Vary", "Accept-Language")
+		_, _ = rw.Write([]byte(`{"greeting":"` + req.Header.Get("Accept-Language") + `"}`))
+	}))
+
+	for _, language := range []string{"en", "de", "en"} {
+		req := newCallbackRequest(`{"input":1}`)
+		req.Header.Set("Accept-Language", language)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	tracks := backend.Calls("/track")
+	lookups := backend.Calls("/result")
+	if len(tracks) != 3 || len(lookups) != 3 {
+		t.Fatalf("expected three track and lookup calls, got %d and %d", len(tracks), len(lookups))
+	}
+	if tracks[0].Payload["Key"] == tracks[1].Payload["Key"] || tracks[0].Payload["Key"] != tracks[2].Payload["Key"] {
+		t.Errorf("expected the language variants to be keyed distinctly, got %v", []interface{}{tracks[0].Payload["Key"], tracks[1].Payload["Key"], tracks[2].Payload["Key"]})
+	}
+	if !reflect.DeepEqual(tracks[1].Payload["Vary"], map[string]interface{}{"Accept-Language": "de"}) {
+		t.Errorf("expected the varied header in the payload, got %v", tracks[1].Payload["Vary"])
+	}
+	// Once the Vary is known, lookups use the key the variant was offered with
+	if lookups[2].Payload["Key"] != tracks[0].Payload["Key"] {
+		t.Errorf("expected the lookup to use the variant key, got %v", lookups[2].Payload["Key"])
+	}
+}
+
+func TestKeyExcludeHeaders(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.KeyExcludeHeaders = []string{"x-request-id"}
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Vary", "Accept-Language, X-Request-Id")
+		_, _ = rw.Write([]byte(`{"response":"ok"}`))
+	}))
+
+	for _, requestID := range []string{"1", "2"} {
+		req := newCallbackRequest(`{"input":1}`)
+		req.Header.Set("Accept-Language", "en")
+		req.Header.Set("X-Request-Id", requestID)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 2 {
+		t.Fatalf("expected two track calls, got %d", len(tracks))
+	}
+	if tracks[0].Payload["Key"] != tracks[1].Payload["Key"] {
+		t.Errorf("expected the excluded header not to change the key, got %v and %v", tracks[0].Payload["Key"], tracks[1].Payload["Key"])
+	}
+	if !reflect.DeepEqual(tracks[1].Payload["Vary"], map[string]interface{}{"Accept-Language": "en"}) {
+		t.Errorf("expected only the kept header in the payload, got %v", tracks[1].Payload["Vary"])
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	tests := []struct {
+		name     string
+		failOpen bool
+		status   int
+		body     string
+	}{
+		{name: "open", failOpen: true, status: http.StatusOK, body: `{"response":"ok"}`},
+		{name: "closed", failOpen: false, status: http.StatusBadGateway, body: "backend unavailable\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Nothing listens on the backend anymore, every call fails
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.FailOpen = test.failOpen
+			backend.Close()
+			handler := newHandler(t, cfg, nil)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+			if recorder.Code != test.status || recorder.Body.String() != test.body {
+				t.Errorf("expected the callback to get %d %q, got %d %q", test.status, test.body, recorder.Code, recorder.Body.String())
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+			req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+			recorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			if recorder.Code != test.status || recorder.Body.String() != test.body {
+				t.Errorf("expected the layout to get %d %q, got %d %q", test.status, test.body, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestUnreachableResultBackend(t *testing.T) {
+	for _, coalesce := range []bool{false, true} {
+		t.Run(fmt.Sprintf("coalesce=%v", coalesce), func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			// Nothing listens on port 1, the lookup fails without a response
+			cfg.ResultURL = "http://127.0.0.1:1/result"
+			cfg.Features = map[string]bool{"coalesce": coalesce}
+			called := false
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				called = true
+				_, _ = rw.Write([]byte(`{"response":"app"}`))
+			}))
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+			if !called || recorder.Code != http.StatusOK || recorder.Body.String() != `{"response":"app"}` {
+				t.Errorf("expected the failed lookup to be a miss served by the app, got %d %q", recorder.Code, recorder.Body.String())
+			}
+			if tracks := backend.Calls("/track"); len(tracks) != 1 {
+				t.Errorf("expected the response of the app to be tracked, got %d tracks", len(tracks))
+			}
+
+			// Nothing was queued, so a long callback is not answered with a 202 either
+			called = false
+			req := newCallbackRequest(`{"input":2}`)
+			req.Header.Set("X-Longcallback", "1")
+			recorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if !called || recorder.Code != http.StatusOK {
+				t.Errorf("expected the long callback to be served by the app, got %d", recorder.Code)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentLayoutLookups(t *testing.T) {
+	newLayoutRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+		req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+		return req
+	}
+
+	t.Run("wait", func(t *testing.T) {
+		var mu sync.Mutex
+		inFlight, maxInFlight := 0, 0
+		backend := newStubBackend(t)
+		backend.layout = func(rw http.ResponseWriter, _ *http.Request) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			_, _ = rw.Write([]byte(`{"layout":"ok"}`))
+		}
+		cfg := backend.config()
+		cfg.MaxConcurrentLayoutLookups = 2
+		handler := newHandler(t, cfg, nil)
+
+		var wg sync.WaitGroup
+		recorders := make([]*httptest.ResponseRecorder, 6)
+		for i := range recorders {
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(recorder *httptest.ResponseRecorder) {
+				defer wg.Done()
+				handler.ServeHTTP(recorder, newLayoutRequest())
+			}(recorders[i])
+		}
+		wg.Wait()
+
+		if maxInFlight > 2 {
+			t.Errorf("expected at most 2 concurrent layout lookups, got %d", maxInFlight)
+		}
+		for _, recorder := range recorders {
+			if recorder.Body.String() != `{"layout":"ok"}` {
+				t.Errorf("expected every waiting request to get the layout, got %d %q", recorder.Code, recorder.Body.String())
+			}
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		backend := newStubBackend(t)
+		backend.layout = func(rw http.ResponseWriter, _ *http.Request) {
+			close(started)
+			<-release
+			_, _ = rw.Write([]byte(`{"layout":"ok"}`))
+		}
+		cfg := backend.config()
+		cfg.MaxConcurrentLayoutLookups = 1
+		cfg.LayoutBackpressureMode = "reject"
+		handler := newHandler(t, cfg, nil)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handler.ServeHTTP(httptest.NewRecorder(), newLayoutRequest())
+		}()
+		<-started
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newLayoutRequest())
+		close(release)
+		<-done
+
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status 503, got %d", recorder.Code)
+		}
+	})
+
+	t.Run("wait timeout", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		backend := newStubBackend(t)
+		backend.layout = func(rw http.ResponseWriter, _ *http.Request) {
+			close(started)
+			<-release
+			_, _ = rw.Write([]byte(`{"layout":"ok"}`))
+		}
+		cfg := backend.config()
+		cfg.MaxConcurrentLayoutLookups = 1
+		cfg.LayoutQueueTimeout = "20ms"
+		handler := newHandler(t, cfg, nil)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handler.ServeHTTP(httptest.NewRecorder(), newLayoutRequest())
+		}()
+		<-started
+
+		start := time.Now()
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newLayoutRequest())
+		elapsed := time.Since(start)
+		close(release)
+		<-done
+
+		if recorder.Code != http.StatusServiceUnavailable || elapsed > 2*time.Second {
+			t.Errorf("expected a 503 once the queue timeout expired, got %d after %v", recorder.Code, elapsed)
+		}
+	})
+}
+
+func TestStripCookiePrefixes(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.StripCookiePrefixes = []string{"_forward_auth", "session_"}
+	var forwarded string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Get("Cookie")
+	}))
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("Cookie", "_forward_auth=secret; session_id=secret; theme=dark; _oauth2_proxy=kept")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if forwarded != "theme=dark; _oauth2_proxy=kept" {
+		t.Errorf("expected only the cookies matching no prefix to be forwarded, got %q", forwarded)
+	}
+}
+
+func TestCookieValues(t *testing.T) {
+	tests := []struct {
+		name      string
+		cookies   []string
+		forwarded []string
+	}{
+		{
+			name:      "base64 padding",
+			cookies:   []string{"_oauth2_proxy=c2VjcmV0==; token=dG9rZW4=; empty="},
+			forwarded: []string{"token=dG9rZW4=; empty="},
+		},
+		{
+			name:      "quoted semicolons",
+			cookies:   []string{`prefs="a=1; b=2"; _oauth2_proxy=secret; theme=dark`},
+			forwarded: []string{`prefs="a=1; b=2"; theme=dark`},
+		},
+		{
+			name:      "auth cookie in a quoted value",
+			cookies:   []string{`smuggled="x; _oauth2_proxy=secret"; theme=dark`},
+			forwarded: []string{"theme=dark"},
+		},
+		{
+			name:      "multiple headers",
+			cookies:   []string{"a=1==; _oauth2_proxy=secret", "_oauth2_proxy_1=secret", `b="c;d"`},
+			forwarded: []string{"a=1==", `b="c;d"`},
+		},
+		{
+			name:      "unchanged",
+			cookies:   []string{"a=x=y; b=\"q\""},
+			forwarded: []string{"a=x=y; b=\"q\""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			var forwarded []string
+			handler := newHandler(t, backend.config(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req.Header.Values("Cookie")
+			}))
+
+			req := newCallbackRequest(`{"input":1}`)
+			for _, cookie := range test.cookies {
+				req.Header.Add("Cookie", cookie)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !reflect.DeepEqual(forwarded, test.forwarded) {
+				t.Errorf("expected %q to be forwarded, got %q", test.forwarded, forwarded)
+			}
+		})
+	}
+}
+
+func TestPreservedDownstreamHeaders(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.StripDownstreamHeaders = []string{"Accept*", "content-type", "Accept-Language", "X-*"}
+	var forwarded http.Header
+	var forwardedBody []byte
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Clone()
+		forwardedBody, _ = io.ReadAll(req.Body)
+	}))
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Accept-Language", "de-CH")
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	for name, expected := range map[string]string{
+		"Accept":          "application/json",
+		"Accept-Language": "de-CH",
+		"Content-Type":    "application/json; charset=utf-8",
+		"Accept-Encoding": "",
+	} {
+		if got := forwarded.Get(name); got != expected {
+			t.Errorf("expected %s %q downstream, got %q", name, expected, got)
+		}
+	}
+	if string(forwardedBody) != `{"input":1}` {
+		t.Errorf("expected the body downstream, got %q", forwardedBody)
+	}
+}
+
+func TestEmailHeaders(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.EmailHeaders = []string{"X-Forwarded-Email", "X-Auth-Request-Preferred-Username"}
+	handler := newHandler(t, cfg, nil)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Del("X-Auth-Request-Email")
+	req.Header.Set("X-Auth-Request-Preferred-Username", "fallback")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = newCallbackRequest(`{"input":2}`)
+	req.Header.Set("X-Forwarded-Email", "forwarded@example.com")
+	req.Header.Set("X-Auth-Request-Preferred-Username", "fallback")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 2 {
+		t.Fatalf("expected two track calls, got %d", len(tracks))
+	}
+	if got := tracks[0].Payload["Email"]; !reflect.DeepEqual(got, []interface{}{"fallback"}) {
+		t.Errorf("expected the email from the second header, got %v", got)
+	}
+	if got := tracks[1].Payload["Email"]; !reflect.DeepEqual(got, []interface{}{"forwarded@example.com"}) {
+		t.Errorf("expected the email from the first header with a value, got %v", got)
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.MaxBodyBytes = 16
+	called := false
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		called = true
+		_, _ = rw.Write([]byte(`{"response":"larger than the limit"}`))
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":"larger than the limit"}`))
+	if recorder.Code != http.StatusRequestEntityTooLarge || called {
+		t.Errorf("expected a 413 without downstream call, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+	if recorder.Body.String() != `{"response":"larger than the limit"}` {
+		t.Errorf("expected the client to get the whole response, got %q", recorder.Body.String())
+	}
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track call, got %d", len(tracks))
+	}
+	if tracks[0].Payload["Result"] != "" || tracks[0].Payload["ResultTruncated"] != true || tracks[0].Payload["Cacheable"] != false {
+		t.Errorf("expected the oversized result not to be captured, got %v", tracks[0].Payload)
+	}
+}
+
+func TestMethodOverrideHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		trusted   bool
+		cacheable bool
+	}{
+		{name: "trusted", trusted: true, cacheable: true},
+		{name: "untrusted"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.CacheIdempotentOnly = true
+			cfg.MethodOverrideHeader = "X-HTTP-Method-Override"
+			cfg.TrustMethodOverride = tc.trusted
+			var forwardedMethod string
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwardedMethod = req.Method
+			}))
+
+			req := newCallbackRequest(`{"input":1}`)
+			req.Header.Set("X-HTTP-Method-Override", "get")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if forwardedMethod != http.MethodPost {
+				t.Errorf("expected the request to be forwarded as POST, got %s", forwardedMethod)
+			}
+			if lookups := backend.Calls("/result"); tc.cacheable != (len(lookups) == 1) {
+				t.Errorf("expected cacheable %v, got %d result lookups", tc.cacheable, len(lookups))
+			}
+		})
+	}
+}
+
+func TestPanicTracking(t *testing.T) {
+	for _, downstreamTimeout := range []string{"", "1s"} {
+		t.Run("timeout "+downstreamTimeout, func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.DownstreamTimeout = downstreamTimeout
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				panic("no layout for user@example.com")
+			}))
+
+			func() {
+				defer func() {
+					if p := recover(); p != "no layout for user@example.com" {
+						t.Errorf("expected the original panic to go on, got %v", p)
+					}
+				}()
+				handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+			}()
+
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			if got := tracks[0].Payload["PanicMessage"]; got != "no layout for REDACTED" {
+				t.Errorf("expected the redacted panic message, got %v", got)
+			}
+			stack, _ := tracks[0].Payload["PanicStack"].(string)
+			if !strings.Contains(stack, "TestPanicTracking") || len(stack) > 4<<10 {
+				t.Errorf("expected a bounded stack of the downstream, got %d bytes", len(stack))
+			}
+			if tracks[0].Payload["Cacheable"] != false {
+				t.Error("expected a panicking request not to be cacheable")
+			}
+		})
+	}
+}
+
+func TestAbortHandlerPanic(t *testing.T) {
+	for _, trackAborted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("track aborted %v", trackAborted), func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.TrackAborted = trackAborted
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_, _ = rw.Write([]byte(`{"resp`))
+				panic(http.ErrAbortHandler)
+			}))
+
+			func() {
+				defer func() {
+					if p := recover(); p != http.ErrAbortHandler {
+						t.Errorf("expected the abort to go on, got %v", p)
+					}
+				}()
+				handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+			}()
+
+			tracks := backend.Calls("/track")
+			if !trackAborted {
+				if len(tracks) != 0 {
+					t.Errorf("expected an aborted response not to be tracked, got %d track calls", len(tracks))
+				}
+				return
+			}
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			if _, found := tracks[0].Payload["PanicMessage"]; found || tracks[0].Payload["Aborted"] != true || tracks[0].Payload["Cacheable"] != false {
+				t.Errorf("expected an aborted response without panic, got %v", tracks[0].Payload)
+			}
+		})
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		cacheable bool
+	}{
+		{status: http.StatusOK, cacheable: true},
+		{status: http.StatusNoContent, cacheable: true},
+		{status: http.StatusInternalServerError},
+	} {
+		t.Run(strconv.Itoa(tc.status), func(t *testing.T) {
+			backend := newStubBackend(t)
+			handler := newHandler(t, backend.config(), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.WriteHeader(tc.status)
+			}))
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+			if recorder.Code != tc.status {
+				t.Errorf("expected the client to get %d, got %d", tc.status, recorder.Code)
+			}
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			if got := tracks[0].Payload["StatusCode"]; got != float64(tc.status) {
+				t.Errorf("expected StatusCode %d, got %v", tc.status, got)
+			}
+			if got := tracks[0].Payload["Cacheable"]; got != tc.cacheable {
+				t.Errorf("expected Cacheable %v, got %v", tc.cacheable, got)
+			}
+		})
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.MetricsEnabled = true
+	handler := newHandler(t, cfg, nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+	req := newCallbackRequest(`{"input":2}`)
+	req.Header.Set("X-Longcallback", "1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	backend.result = cachedResult(`{"response":"cached"}`)
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost/dashmiddleware/metrics", http.NoBody))
+
+	for _, expected := range []string{
+		`dashmiddleware_cache_hits_total{pattern="/_dash-update-component"} 1`,
+		`dashmiddleware_cache_misses_total{pattern="/_dash-update-component"} 2`,
+		`dashmiddleware_long_callback_accepted_total{pattern="/_dash-update-component"} 1`,
+		`dashmiddleware_backend_duration_seconds_count{target="result"} 3`,
+		`dashmiddleware_backend_duration_seconds_count{target="track"} 2`,
+	} {
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("expected %q in the metrics, got\n%s", expected, recorder.Body.String())
+		}
+	}
+
+	cfg.MetricsEnabled = false
+	recorder = httptest.NewRecorder()
+	newHandler(t, cfg, nil).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost/dashmiddleware/metrics", http.NoBody))
+	if recorder.Body.String() != `{"response":"ok"}` {
+		t.Errorf("expected the metrics path to reach the app when disabled, got %q", recorder.Body.String())
+	}
+}
+
+func TestCacheKeyVersion(t *testing.T) {
+	keys := map[string]interface{}{}
+	for _, version := range []string{"v1", "v2"} {
+		backend := newStubBackend(t)
+		cfg := backend.config()
+		cfg.CacheKeyVersion = version
+		handler := newHandler(t, cfg, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+		lookups, tracks := backend.Calls("/result"), backend.Calls("/track")
+		if len(lookups) != 1 || len(tracks) != 1 {
+			t.Fatalf("expected one lookup and one track call, got %d and %d", len(lookups), len(tracks))
+		}
+		if lookups[0].Payload["KeyVersion"] != version || tracks[0].Payload["KeyVersion"] != version {
+			t.Errorf("expected the key version %s in the payloads", version)
+		}
+		if lookups[0].Payload["Key"] != tracks[0].Payload["Key"] {
+			t.Errorf("expected the lookup and track keys to match, got %v and %v", lookups[0].Payload["Key"], tracks[0].Payload["Key"])
+		}
+		keys[version] = tracks[0].Payload["Key"]
+	}
+
+	if keys["v1"] == keys["v2"] {
+		t.Errorf("expected different versions to produce different keys, got %v", keys["v1"])
+	}
+}
+
+func TestDecompressionBounds(t *testing.T) {
+	// A small compressed body that expands to a lot of zeros
+	var bomb bytes.Buffer
+	writer := gzip.NewWriter(&bomb)
+	_, _ = writer.Write(make([]byte, 20<<20))
+	_ = writer.Close()
+
+	tests := []struct {
+		name      string
+		configure func(*dashmiddleware.Config)
+	}{
+		{"max decompressed bytes", func(cfg *dashmiddleware.Config) { cfg.MaxDecompressedBytes = 1 << 20 }},
+		{"min compressed bytes", func(cfg *dashmiddleware.Config) { cfg.DecompressMinBytes = int64(bomb.Len()) + 1 }},
+		{"max compressed bytes", func(cfg *dashmiddleware.Config) { cfg.DecompressMaxBytes = int64(bomb.Len()) - 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			tt.configure(cfg)
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header().Set("Content-Encoding", "gzip")
+				_, _ = rw.Write(bomb.Bytes())
+			}))
+
+			handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			if tracks[0].Payload["ResultError"] == nil {
+				t.Error("expected a result error")
+			}
+			if result, _ := tracks[0].Payload["Result"].(string); result != "" {
+				t.Errorf("expected no result, got %d bytes", len(result))
+			}
+			if tracks[0].Payload["Cacheable"] != false {
+				t.Errorf("expected the result not to be cacheable, got %v", tracks[0].Payload["Cacheable"])
+			}
+		})
+	}
+}
+
+func TestRefererPatterns(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.FrameParam = "view"
+	cfg.LayoutParam = "dash-layout"
+	cfg.BaseURLPattern = `https?://[^/]+(.+?)/\?`
+	handler := newHandler(t, cfg, nil)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("Referer", "http://internal:8080/tools/app/?view=frame1&dash-layout=layout1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track call, got %d", len(tracks))
+	}
+	if payload := tracks[0].Payload; payload["Frame"] != "frame1" || payload["RefererBase"] != "/tools/app" {
+		t.Errorf("expected the frame and base from the custom patterns, got %v and %v", payload["Frame"], payload["RefererBase"])
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+	req.Header.Set("Referer", "http://internal:8080/tools/app/?view=frame1&dash-layout=layout1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	layouts := backend.Calls("/getlayout")
+	if len(layouts) != 1 || layouts[0].Payload["layout"] != "layout1" {
+		t.Errorf("expected one layout call for layout1, got %v", layouts)
+	}
+}
+
+func TestInvalidBaseURLPattern(t *testing.T) {
+	for _, pattern := range []string{`(`, `https://[^/]+/`} {
+		cfg := dashmiddleware.CreateConfig()
+		cfg.BaseURLPattern = pattern
+		if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Errorf("expected an error for the base url pattern %q", pattern)
+		}
+	}
+}
+
+func TestServedCompressed(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write([]byte(`{"response":1}`))
+	_ = writer.Close()
+
+	for _, encoding := range []string{"gzip", ""} {
+		t.Run("encoding "+encoding, func(t *testing.T) {
+			backend := newStubBackend(t)
+			handler := newHandler(t, backend.config(), http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				if encoding == "gzip" {
+					rw.Header().Set("Content-Encoding", "gzip")
+					_, _ = rw.Write(compressed.Bytes())
+					return
+				}
+				_, _ = rw.Write([]byte(`{"response":1}`))
+			}))
+
+			handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			if got, expected := tracks[0].Payload["ServedCompressed"], encoding != ""; got != expected {
+				t.Errorf("expected ServedCompressed %v, got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestHTTPRefererBase(t *testing.T) {
+	backend := newStubBackend(t)
+	handler := newHandler(t, backend.config(), nil)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("Referer", "http://localhost/app/?frame=frame1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track call, got %d", len(tracks))
+	}
+	if got := tracks[0].Payload["RefererBase"]; got != "/app" {
+		t.Errorf("expected the referer base /app, got %v", got)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+		if len(backend.Calls("/result")) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		cachedResult(`{"response":"cached"}`)(rw, nil)
+	}
+	backend.track = func(rw http.ResponseWriter, _ *http.Request) {
+		if len(backend.Calls("/track")) < 2 {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+	cfg := backend.config()
+	cfg.MaxRetries = 3
+	cfg.RetryBackoff = "1ms"
+	handler := newHandler(t, cfg, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("expected the retried lookup to be served from the cache")
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+	if recorder.Body.String() != `{"response":"cached"}` {
+		t.Errorf("expected the cached result, got %q", recorder.Body.String())
+	}
+	if lookups := backend.Calls("/result"); len(lookups) != 3 {
+		t.Errorf("expected two failed lookups and a successful retry, got %d", len(lookups))
+	}
+	if tracks := backend.Calls("/track"); len(tracks) != 2 {
+		t.Errorf("expected a failed track call and a successful retry, got %d", len(tracks))
+	}
+}
+
+func TestRetryHonorsCancellation(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	cfg := backend.config()
+	cfg.MaxRetries = 5
+	cfg.RetryBackoff = "1h"
+	handler := newHandler(t, cfg, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`).WithContext(ctx))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the retry backoff to end with the request context")
+	}
+	if lookups := backend.Calls("/result"); len(lookups) != 1 {
+		t.Errorf("expected a single lookup before the request was cancelled, got %d", len(lookups))
+	}
+}
+
+func TestTrackRetriesPrecedence(t *testing.T) {
+	for _, test := range []struct {
+		trackRetries int
+		tracks       int
+	}{
+		{trackRetries: -1, tracks: 3},
+		{trackRetries: 0, tracks: 1},
+		{trackRetries: 1, tracks: 2},
+	} {
+		t.Run(fmt.Sprintf("trackretries %d", test.trackRetries), func(t *testing.T) {
+			backend := newStubBackend(t)
+			backend.track = func(rw http.ResponseWriter, _ *http.Request) {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+			}
+			cfg := backend.config()
+			cfg.MaxRetries = 2
+			cfg.TrackRetries = test.trackRetries
+			cfg.RetryBackoff = "1ms"
+			handler := newHandler(t, cfg, nil)
+
+			handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+			if tracks := backend.Calls("/track"); len(tracks) != test.tracks {
+				t.Errorf("expected %d track calls, got %d", test.tracks, len(tracks))
+			}
+		})
+	}
+
+	cfg := newStubBackend(t).config()
+	cfg.TrackRetries = -2
+	if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil || !strings.Contains(err.Error(), "trackretries") {
+		t.Errorf("expected the trackretries to be rejected, got %v", err)
+	}
+}
+
+func TestCloseStopsTrackRetries(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.track = func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	cfg := backend.config()
+	cfg.AsyncTracking = true
+	cfg.TrackRetries = 3
+	cfg.RetryBackoff = "1h"
+	handler := newHandler(t, cfg, nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(backend.Calls("/track")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- handler.(*dashmiddleware.DashMiddleware).Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to end the backoff of the retry")
+	}
+	if tracks := backend.Calls("/track"); len(tracks) != 1 {
+		t.Errorf("expected the retries to be given up on Close, got %d track calls", len(tracks))
+	}
+}
+
+func TestTrackNonRecorded(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled %v", enabled), func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.TrackNonRecorded = enabled
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.WriteHeader(http.StatusNotFound)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/app/assets/style.css", http.NoBody)
+			req.Header.Set("Referer", "https://localhost/app/?frame=frame1")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != http.StatusNotFound {
+				t.Errorf("expected the downstream status to pass through, got %d", recorder.Code)
+			}
+			if lookups := backend.Calls("/result"); len(lookups) != 0 {
+				t.Errorf("expected no lookups for a non-recorded request, got %d", len(lookups))
+			}
+			tracks := backend.Calls("/track")
+			if !enabled {
+				if len(tracks) != 0 {
+					t.Errorf("expected no track calls when disabled, got %d", len(tracks))
+				}
+				return
+			}
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			payload := tracks[0].Payload
+			if payload["Recorded"] != false || payload["URL"] != "http://localhost/app/assets/style.css" || payload["StatusCode"] != float64(http.StatusNotFound) || payload["Frame"] != "frame1" {
+				t.Errorf("expected a metadata track event of the request, got %v", payload)
+			}
+			if _, ok := payload["Result"]; ok {
+				t.Error("expected no result in a metadata track event")
+			}
+		})
+	}
+}
+
+func TestFrameCacheTTL(t *testing.T) {
+	tests := []struct {
+		referer string
+		ttl     interface{}
+	}{
+		{referer: "https://localhost/app/?frame=frame1", ttl: float64(300)},
+		{referer: "https://localhost/app/?frame=other", ttl: float64(3600)},
+	}
+
+	for _, test := range tests {
+		backend := newStubBackend(t)
+		cfg := backend.config()
+		cfg.FrameCacheTTL = map[string]string{"frame1": "5m"}
+		cfg.DefaultCacheTTL = "1h"
+		handler := newHandler(t, cfg, nil)
+
+		req := newCallbackRequest(`{"input":1}`)
+		req.Header.Set("Referer", test.referer)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		lookups, tracks := backend.Calls("/result"), backend.Calls("/track")
+		if len(lookups) != 1 || len(tracks) != 1 {
+			t.Fatalf("expected one lookup and one track call, got %d and %d", len(lookups), len(tracks))
+		}
+		if lookups[0].Payload["TTL"] != test.ttl || tracks[0].Payload["TTL"] != test.ttl {
+			t.Errorf("expected a TTL of %v for %s, got %v and %v", test.ttl, test.referer, lookups[0].Payload["TTL"], tracks[0].Payload["TTL"])
+		}
+	}
+}
+
+func TestInvalidFrameCacheTTL(t *testing.T) {
+	cfg := dashmiddleware.CreateConfig()
+	cfg.FrameCacheTTL = map[string]string{"frame1": "soon"}
+
+	if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatal("expected an error for an invalid frame cache TTL")
+	}
+}
+
+func TestDecodeTrackBody(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write([]byte(`{"response":1}`))
+	_ = writer.Close()
+
+	for _, decode := range []bool{true, false} {
+		t.Run(fmt.Sprintf("decode %v", decode), func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.DecodeTrackBody = decode
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header().Set("Content-Encoding", "gzip")
+				_, _ = rw.Write(compressed.Bytes())
+			}))
+
+			handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			if tracks[0].Payload["Result"] != `{"response":1}` {
+				t.Errorf("expected the decompressed result, got %v", tracks[0].Payload["Result"])
+			}
+			expected := "gzip"
+			if decode {
+				expected = ""
+			}
+			if got := tracks[0].Header.Get("Content-Encoding"); got != expected {
+				t.Errorf("expected the track Content-Encoding %q, got %q", expected, got)
+			}
+		})
+	}
+}
+
+func TestTrackQueueMaxBytes(t *testing.T) {
+	for _, drop := range []string{"newest", "oldest"} {
+		t.Run(drop, func(t *testing.T) {
+			backend := newStubBackend(t)
+			release := make(chan struct{})
+			t.Cleanup(func() { close(release) })
+			backend.track = func(rw http.ResponseWriter, _ *http.Request) {
+				<-release
+				rw.WriteHeader(http.StatusOK)
+			}
+			result := strings.Repeat("x", 10000)
+			cfg := backend.config()
+			cfg.AsyncTracking = true
+			cfg.TrackQueueMaxBytes = 15000
+			cfg.TrackQueueDrop = drop
+			handler := newHandler(t, cfg, cachedResult(result))
+			middleware := handler.(*dashmiddleware.DashMiddleware)
+
+			// The worker blocks on the first track request, the queue only fits one more
+			for i := 1; i <= 4; i++ {
+				handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(fmt.Sprintf(`{"input":%d}`, i)))
+			}
+			dropped := middleware.Counter("dashmiddleware_track_dropped_total", "reason", "queue_full")
+			if dropped < 2 {
+				t.Fatalf("expected at least two dropped track requests, got %d", dropped)
+			}
+
+			release <- struct{}{}
+			deadline := time.Now().Add(5 * time.Second)
+			for int64(len(backend.Calls("/track"))) < 4-dropped && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			tracks := backend.Calls("/track")
+			if int64(len(tracks)) != 4-dropped {
+				t.Fatalf("expected %d track calls, got %d", 4-dropped, len(tracks))
+			}
+			last := tracks[len(tracks)-1].Payload["Request"]
+			if keepsNewest := last == `{"input":4}`; keepsNewest != (drop == "oldest") {
+				t.Errorf("expected dropping the %s track requests, the last one sent was %v", drop, last)
+			}
+		})
+	}
+}
+
+func TestTrackQueueOversizedJob(t *testing.T) {
+	backend := newStubBackend(t)
+	release := make(chan struct{})
+	backend.track = func(rw http.ResponseWriter, _ *http.Request) {
+		<-release
+		rw.WriteHeader(http.StatusOK)
+	}
+	cfg := backend.config()
+	cfg.AsyncTracking = true
+	cfg.TrackQueueMaxBytes = 15000
+	cfg.TrackQueueDrop = "oldest"
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if string(body) == `{"input":4}` {
+			_, _ = rw.Write([]byte(strings.Repeat("x", 20000)))
+			return
+		}
+		_, _ = rw.Write([]byte(`{"response":1}`))
+	}))
+	middleware := handler.(*dashmiddleware.DashMiddleware)
+
+	// The small track requests fit, the last one never does
+	for i := 1; i <= 4; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(fmt.Sprintf(`{"input":%d}`, i)))
+	}
+	if dropped := middleware.Counter("dashmiddleware_track_dropped_total", "reason", "queue_full"); dropped != 1 {
+		t.Errorf("expected only the oversized track request to be dropped, got %d", dropped)
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(backend.Calls("/track")) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(backend.Calls("/track")); n != 3 {
+		t.Errorf("expected the queued track requests to be sent, got %d track calls", n)
+	}
+}
+
+func TestAsyncTrackingClose(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	release := make(chan struct{})
+	backend := newStubBackend(t)
+	backend.track = func(rw http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}
+	cfg := backend.config()
+	cfg.AsyncTracking = true
+	cfg.TrackWorkers = 2
+	cfg.TrackTimeout = "5s"
+	handler := newHandler(t, cfg, nil)
+	middleware := handler.(*dashmiddleware.DashMiddleware)
+
+	// The responses do not wait for the blocked track backend
+	start := time.Now()
+	for i := 1; i <= 4; i++ {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, newCallbackRequest(fmt.Sprintf(`{"input":%d}`, i)))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", recorder.Code)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the requests not to wait for tracking, took %v", elapsed)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- middleware.Close() }()
+	select {
+	case <-closed:
+		t.Fatal("expected Close to wait for the queued track requests")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(backend.Calls("/track")); n != 4 {
+		t.Errorf("expected all 4 track requests to be sent before Close returned, got %d", n)
+	}
+	if maxInFlight != 2 {
+		t.Errorf("expected 2 concurrent track requests, got %d", maxInFlight)
+	}
+
+	// Once closed, track requests are dropped rather than blocking
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":5}`))
+	if dropped := middleware.Counter("dashmiddleware_track_dropped_total", "reason", "closed"); dropped != 1 {
+		t.Errorf("expected the track request after Close to be dropped, got %d", dropped)
+	}
+}
+
+func TestCloseGracePeriod(t *testing.T) {
+	t.Run("idle", func(t *testing.T) {
+		backend := newStubBackend(t)
+		middleware := newHandler(t, backend.config(), nil).(*dashmiddleware.DashMiddleware)
+
+		for i := 0; i < 2; i++ {
+			if err := middleware.Close(); err != nil {
+				t.Errorf("expected close %d to succeed, got %v", i+1, err)
+			}
+		}
+	})
+
+	t.Run("stuck track request", func(t *testing.T) {
+		backend := newStubBackend(t)
+		release := make(chan struct{})
+		t.Cleanup(func() { close(release) })
+		backend.track = func(rw http.ResponseWriter, _ *http.Request) {
+			<-release
+		}
+		cfg := backend.config()
+		cfg.AsyncTracking = true
+		cfg.TrackTimeout = "5s"
+		cfg.ShutdownGracePeriod = "50ms"
+		handler := newHandler(t, cfg, nil)
+		middleware := handler.(*dashmiddleware.DashMiddleware)
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+		start := time.Now()
+		err := middleware.Close()
+		if err == nil || time.Since(start) > time.Second {
+			t.Errorf("expected Close to give up after the grace period, got %v after %v", err, time.Since(start))
+		}
+		if again := middleware.Close(); again != err {
+			t.Errorf("expected a second Close to return %v, got %v", err, again)
+		}
+	})
+}
+
+func TestStreamResponses(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.MaxBodyBytes = 16
+	cfg.StreamResponses = true
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte(`{"response":`))
+		_, _ = rw.Write([]byte(`"larger than the limit"}`))
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+	if recorder.Body.String() != `{"response":"larger than the limit"}` || !recorder.Flushed {
+		t.Errorf("expected the whole response to be streamed to the client, got %q flushed %v", recorder.Body.String(), recorder.Flushed)
+	}
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 {
+		t.Fatalf("expected one track call, got %d", len(tracks))
+	}
+	if tracks[0].Payload["Result"] != `{"response":"lar` || tracks[0].Payload["ResultTruncated"] != true || tracks[0].Payload["Cacheable"] != false {
+		t.Errorf("expected the result truncated to the limit, got %v", tracks[0].Payload)
+	}
+}
+
+func TestStreamResponsesDownstreamTimeout(t *testing.T) {
+	for _, started := range []bool{true, false} {
+		t.Run(fmt.Sprintf("started %v", started), func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.StreamResponses = true
+			cfg.DownstreamTimeout = "50ms"
+			recorder := httptest.NewRecorder()
+			streamed := ""
+			var lateErr error
+			handlerDone := make(chan struct{})
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				defer close(handlerDone)
+				if started {
+					_, _ = rw.Write([]byte(`{"response":`))
+					// The client has the first part before the handler returns
+					streamed = recorder.Body.String()
+				}
+				<-req.Context().Done()
+				_, lateErr = rw.Write([]byte(`"late"}`))
+			}))
+
+			handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+			<-handlerDone
+
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 || tracks[0].Payload["TimeoutStage"] != "downstream" || tracks[0].Payload["Cacheable"] != false {
+				t.Fatalf("expected the downstream timeout to be tracked, got %v", tracks)
+			}
+			if !started {
+				if recorder.Code != http.StatusGatewayTimeout {
+					t.Errorf("expected a 504 when nothing was streamed yet, got %d", recorder.Code)
+				}
+				return
+			}
+			if streamed != `{"response":` {
+				t.Errorf("expected the response to be streamed before the deadline, got %q", streamed)
+			}
+			if recorder.Code != http.StatusOK || recorder.Body.String() != `{"response":` {
+				t.Errorf("expected the started response to be cut off at the deadline, got %d %q", recorder.Code, recorder.Body.String())
+			}
+			if lateErr != http.ErrHandlerTimeout {
+				t.Errorf("expected writes after the deadline to fail, got %v", lateErr)
+			}
+		})
+	}
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	for _, tc := range []struct {
+		mode      string
+		cacheable bool
+	}{
+		{mode: "nocache", cacheable: false},
+		{mode: "correct", cacheable: true},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.OnContentLengthMismatch = tc.mode
+			handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header().Set("Content-Length", "100")
+				_, _ = rw.Write([]byte(`{"response":1}`))
+			}))
+			middleware := handler.(*dashmiddleware.DashMiddleware)
+
+			handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+			tracks := backend.Calls("/track")
+			if len(tracks) != 1 {
+				t.Fatalf("expected one track call, got %d", len(tracks))
+			}
+			if got := tracks[0].Payload["Cacheable"]; got != tc.cacheable {
+				t.Errorf("expected Cacheable %v, got %v", tc.cacheable, got)
+			}
+			if n := middleware.Counter("dashmiddleware_content_length_mismatches_total"); n != 1 {
+				t.Errorf("expected one counted mismatch, got %d", n)
+			}
+		})
+	}
+}
+
+func TestContentLengthInjectedCacheHit(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.result = cachedResult(`{"response":"cached"}`)
+	cfg := backend.config()
+	cfg.InjectCacheMetadata = true
+	cfg.OnContentLengthMismatch = "nocache"
+	handler := newHandler(t, cfg, nil)
+	middleware := handler.(*dashmiddleware.DashMiddleware)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newCallbackRequest(`{"input":1}`))
+
+	if got := recorder.Header().Get("Content-Length"); got != strconv.Itoa(recorder.Body.Len()) {
+		t.Errorf("expected the Content-Length of the injected body, got %s for %d bytes", got, recorder.Body.Len())
+	}
+	tracks := backend.Calls("/track")
+	if len(tracks) != 1 || tracks[0].Payload["Cacheable"] != true {
+		t.Errorf("expected the injected hit to be tracked as cacheable, got %v", tracks)
+	}
+	if n := middleware.Counter("dashmiddleware_content_length_mismatches_total"); n != 0 {
+		t.Errorf("expected no counted mismatch for an injected hit, got %d", n)
+	}
+}
+
+func TestInvalidOnContentLengthMismatch(t *testing.T) {
+	cfg := dashmiddleware.CreateConfig()
+	cfg.OnContentLengthMismatch = "ignore"
+
+	if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatal("expected an error for an invalid oncontentlengthmismatch")
+	}
+}
+
+func TestLongCallbackHeader(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.LongCallbackHeader = "X-Dashpool-Long-Callback"
+	handler := newHandler(t, cfg, nil)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("X-Dashpool-Long-Callback", "1")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusAccepted {
+		t.Errorf("expected the long callback to be accepted, got %d", recorder.Code)
+	}
+
+	req = newCallbackRequest(`{"input":2}`)
+	req.Header.Set("X-Longcallback", "1")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected the default header to be ignored, got %d", recorder.Code)
+	}
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.HealthEnabled = true
+	handler := newHandler(t, cfg, nil)
+	middleware := handler.(*dashmiddleware.DashMiddleware)
+
+	if err := middleware.Healthy(context.Background()); err != nil {
+		t.Errorf("expected reachable backends to be healthy, got %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost/dashmiddleware/healthz", http.NoBody))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("expected a healthy status, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := middleware.Healthy(context.Background()); err == nil || !strings.Contains(err.Error(), "result backend") {
+		t.Errorf("expected the result backend to be unhealthy, got %v", err)
+	}
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://localhost/dashmiddleware/healthz", http.NoBody))
+	var status struct {
+		Status string            `json:"status"`
+		Errors map[string]string `json:"errors"`
+	}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &status)
+	if recorder.Code != http.StatusServiceUnavailable || status.Status != "unhealthy" || status.Errors["result"] == "" || len(status.Errors) != 1 {
+		t.Errorf("expected only the result backend to be reported unhealthy, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	backend.Close()
+	if err := middleware.Healthy(context.Background()); err == nil || !strings.Contains(err.Error(), "track backend") {
+		t.Errorf("expected an unreachable backend to be unhealthy, got %v", err)
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.SessionHeader = "X-Session-Id"
+	cfg.SessionCookie = "session"
+	handler := newHandler(t, cfg, nil)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("X-Session-Id", "header-session")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "cookie-session"})
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = newCallbackRequest(`{"input":2}`)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "cookie-session"})
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":3}`))
+
+	tracks := backend.Calls("/track")
+	if len(tracks) != 3 {
+		t.Fatalf("expected three track calls, got %d", len(tracks))
+	}
+	if got := tracks[0].Payload["SessionID"]; got != "header-session" {
+		t.Errorf("expected the session from the header, got %v", got)
+	}
+	if got := tracks[1].Payload["SessionID"]; got != "cookie-session" {
+		t.Errorf("expected the session from the cookie, got %v", got)
+	}
+	if _, ok := tracks[2].Payload["SessionID"]; ok {
+		t.Errorf("expected no session without header or cookie, got %v", tracks[2].Payload["SessionID"])
+	}
+}
+
+func TestCachedLatencyHistogram(t *testing.T) {
+	backend := newStubBackend(t)
+	handler := newHandler(t, backend.config(), nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+	backend.result = cachedResult(`{"response":"cached"}`)
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	recorder := httptest.NewRecorder()
+	handler.(*dashmiddleware.DashMiddleware).MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+
+	for _, expected := range []string{
+		`dashmiddleware_request_duration_seconds_count{frame="frame1",cached="false"} 1`,
+		`dashmiddleware_request_duration_seconds_count{frame="frame1",cached="true"} 2`,
+	} {
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("expected %q in the metrics, got\n%s", expected, recorder.Body.String())
+		}
+	}
+}
+
+// recordingLogger keeps the messages logged at each level.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages map[string][]string
+}
+
+func (l *recordingLogger) record(level, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.messages == nil {
+		l.messages = map[string][]string{}
+	}
+	l.messages[level] = append(l.messages[level], msg)
+}
+
+func (l *recordingLogger) Debug(msg string, _ ...interface{}) { l.record("debug", msg) }
+func (l *recordingLogger) Info(msg string, _ ...interface{})  { l.record("info", msg) }
+func (l *recordingLogger) Error(msg string, _ ...interface{}) { l.record("error", msg) }
+
+func TestSetLogger(t *testing.T) {
+	backend := newStubBackend(t)
+	backend.track = func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+	cfg := backend.config()
+	cfg.TrackRetries = 1
+	cfg.RetryBackoff = "1ms"
+	handler := newHandler(t, cfg, nil)
+	logger := &recordingLogger{}
+	handler.(*dashmiddleware.DashMiddleware).SetLogger(logger)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	if !reflect.DeepEqual(logger.messages["info"], []string{"Retrying track request"}) {
+		t.Errorf("expected the retry at info level, got %v", logger.messages["info"])
+	}
+	if !reflect.DeepEqual(logger.messages["error"], []string{"Failed to track request", "Failed to track request"}) {
+		t.Errorf("expected both failed attempts at error level, got %v", logger.messages["error"])
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	backend := newStubBackend(t)
+	backend.track = func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+	cfg := backend.config()
+	cfg.TrackRetries = 1
+	cfg.RetryBackoff = "1ms"
+	cfg.LogLevel = "error"
+	handler := newHandler(t, cfg, nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+	if !strings.Contains(output.String(), `level=error msg="Failed to track request" status=500`) {
+		t.Errorf("expected the failed track request to be logged, got %q", output.String())
+	}
+	if strings.Contains(output.String(), "level=info") {
+		t.Errorf("expected info lines to be suppressed, got %q", output.String())
+	}
+
+	cfg.LogLevel = "verbose"
+	if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("expected an error for an invalid log level")
+	}
+}
+
+func TestCorruptCachedResult(t *testing.T) {
+	for _, failOpen := range []bool{true, false} {
+		t.Run(fmt.Sprintf("fail open %v", failOpen), func(t *testing.T) {
+			backend := newStubBackend(t)
+			backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header().Set("Content-Encoding", "gzip")
+				_, _ = rw.Write([]byte("not gzip"))
+			}
+			cfg := backend.config()
+			// The client asking for gzip itself gets the cached result as stored
+			cfg.PropagateHeaders = []string{"Accept-Encoding"}
+			cfg.FailOpen = failOpen
+			handler := newHandler(t, cfg, nil)
+
+			req := newCallbackRequest(`{"input":1}`)
+			req.Header.Set("Accept-Encoding", "gzip")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Header().Get("Content-Encoding") != "" {
+				t.Errorf("expected no encoding of the corrupt cached result, got %q", recorder.Header().Get("Content-Encoding"))
+			}
+			tracks := backend.Calls("/track")
+			if failOpen {
+				if recorder.Code != http.StatusOK || recorder.Body.String() != `{"response":"ok"}` || len(tracks) != 1 {
+					t.Errorf("expected the app to serve and track the request, got %d %q and %d track calls", recorder.Code, recorder.Body.String(), len(tracks))
+				}
+				return
+			}
+			if recorder.Code != http.StatusBadGateway || len(tracks) != 0 {
+				t.Errorf("expected an untracked 502 for a corrupt cached result, got %d and %d track calls", recorder.Code, len(tracks))
+			}
+		})
+	}
+}
+
+func TestCachedResultDecompression(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write([]byte(`{"response":"` + strings.Repeat("cached", 100) + `"}`))
+	_ = writer.Close()
+
+	for _, maxDecompressedBytes := range []int64{1 << 20, 100} {
+		t.Run(fmt.Sprintf("limit %d", maxDecompressedBytes), func(t *testing.T) {
+			backend := newStubBackend(t)
+			backend.result = func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header().Set("Content-Encoding", "gzip")
+				_, _ = rw.Write(compressed.Bytes())
+			}
+			cfg := backend.config()
+			cfg.PropagateHeaders = []string{"Accept-Encoding"}
+			cfg.MaxDecompressedBytes = maxDecompressedBytes
+			handler := newHandler(t, cfg, nil)
+
+			req := newCallbackRequest(`{"input":1}`)
+			req.Header.Set("Accept-Encoding", "gzip")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Header().Get("Content-Encoding") != "" {
+				t.Errorf("expected the result to be served decompressed, got encoding %q", recorder.Header().Get("Content-Encoding"))
+			}
+			expected := `{"response":"` + strings.Repeat("cached", 100) + `"}`
+			if maxDecompressedBytes < int64(len(expected)) {
+				// Over the limit the result is not served truncated, the app serves the request
+				expected = `{"response":"ok"}`
+			}
+			if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+				t.Errorf("expected %q, got %d %q", expected, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestRecordedURLMatch(t *testing.T) {
+	tests := []struct {
+		mode         string
+		recordedURLs []string
+		recorded     map[string]bool
+	}{
+		{
+			mode:         "suffix",
+			recordedURLs: []string{"/_dash-update-component"},
+			recorded:     map[string]bool{"/app/_dash-update-component": true, "/evil/_dash-update-component": true, "/app/_dash-update-component/x": false},
+		},
+		{
+			mode:         "exact",
+			recordedURLs: []string{"/app/_dash-update-component"},
+			recorded:     map[string]bool{"/app/_dash-update-component": true, "/evil/_dash-update-component": false, "/app/_dash-update-component/x": false},
+		},
+		{
+			mode:         "regex",
+			recordedURLs: []string{`^/app/_dash-update-component(/.*)?$`},
+			recorded:     map[string]bool{"/app/_dash-update-component": true, "/evil/_dash-update-component": false, "/app/_dash-update-component/x": true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			backend := newStubBackend(t)
+			cfg := backend.config()
+			cfg.RecordedURLMatch = test.mode
+			cfg.RecordedURLs = test.recordedURLs
+			handler := newHandler(t, cfg, nil)
+
+			for path, recorded := range test.recorded {
+				before := len(backend.Calls("/track"))
+				req := httptest.NewRequest(http.MethodPost, "http://localhost"+path, strings.NewReader(`{"input":1}`))
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+				if got := len(backend.Calls("/track")) > before; got != recorded {
+					t.Errorf("expected %s recorded %v, got %v", path, recorded, got)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidRecordedURLPattern(t *testing.T) {
+	cfg := dashmiddleware.CreateConfig()
+	cfg.RecordedURLMatch = "regex"
+	cfg.RecordedURLs = []string{`(`}
+
+	if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatal("expected an error for an invalid recorded URL pattern")
+	}
+}
+
+func TestResultHash(t *testing.T) {
+	body := []byte(`{"response":"ok"}`)
+	sha256Sum := sha256.Sum256(body)
+	sha1Sum := sha1.Sum(body)
+	tests := []struct {
+		algorithm string
+		hash      interface{}
+	}{
+		{algorithm: "", hash: hex.EncodeToString(sha256Sum[:])},
+		{algorithm: "sha1", hash: hex.EncodeToString(sha1Sum[:])},
+		{algorithm: "none", hash: nil},
+	}
+
+	for _, test := range tests {
+		backend := newStubBackend(t)
+		cfg := backend.config()
+		cfg.HashAlgorithm = test.algorithm
+		handler := newHandler(t, cfg, nil)
+
+		handler.ServeHTTP(httptest.NewRecorder(), newCallbackRequest(`{"input":1}`))
+
+		tracks := backend.Calls("/track")
+		if len(tracks) != 1 {
+			t.Fatalf("expected one track call, got %d", len(tracks))
+		}
+		if got := tracks[0].Payload["ResultSize"]; got != float64(len(body)) {
+			t.Errorf("expected a result size of %d, got %v", len(body), got)
+		}
+		if got := tracks[0].Payload["ResultHash"]; got != test.hash {
+			t.Errorf("expected the %q hash %v, got %v", test.algorithm, test.hash, got)
+		}
+	}
+
+	cfg := dashmiddleware.CreateConfig()
+	cfg.HashAlgorithm = "md5"
+	if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("expected an error for an unsupported hash algorithm")
+	}
+}
+
+func TestPropagateHeaders(t *testing.T) {
+	backend := newStubBackend(t)
+	handler := newHandler(t, backend.config(), nil)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	req.Header.Set("X-Request-Id", "request-1")
+	req.Header.Set("X-Other", "not propagated")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/app/_dash-layout", http.NoBody)
+	req.Header.Set("Referer", "https://localhost/app/?frame=frame1&layout=layout1")
+	req.Header.Set("X-Request-Id", "request-2")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	lookups, tracks, layouts := backend.Calls("/result"), backend.Calls("/track"), backend.Calls("/getlayout")
+	if len(lookups) != 1 || len(tracks) != 1 || len(layouts) != 1 {
+		t.Fatalf("expected one lookup, track and layout call, got %d, %d and %d", len(lookups), len(tracks), len(layouts))
+	}
+	for name, call := range map[string]backendCall{"lookup": lookups[0], "track": tracks[0]} {
+		if call.Header.Get("Traceparent") == "" || call.Header.Get("X-Request-Id") != "request-1" {
+			t.Errorf("expected the tracing headers on the %s call, got %v", name, call.Header)
+		}
+		if call.Header.Get("X-Other") != "" {
+			t.Errorf("expected only the configured headers on the %s call", name)
+		}
+	}
+	if got := layouts[0].Header.Get("X-Request-Id"); got != "request-2" {
+		t.Errorf("expected the request id on the layout call, got %q", got)
+	}
+}
+
+// spanLogger keeps the fields of the logged spans by span name.
+type spanLogger struct {
+	recordingLogger
+	spans map[string]map[string]interface{}
+}
+
+func (l *spanLogger) Info(msg string, fields ...interface{}) {
+	if msg != "span" {
+		return
+	}
+	span := map[string]interface{}{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		span[fields[i].(string)] = fields[i+1]
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.spans == nil {
+		l.spans = map[string]map[string]interface{}{}
+	}
+	l.spans[span["span"].(string)] = span
+}
+
+func TestTracing(t *testing.T) {
+	const traceID, parentID = "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.TracingEnabled = true
+	var downstreamTraceparent string
+	handler := newHandler(t, cfg, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		downstreamTraceparent = req.Header.Get("Traceparent")
+		_, _ = rw.Write([]byte(`{"response":"ok"}`))
+	}))
+	logger := &spanLogger{}
+	handler.(*dashmiddleware.DashMiddleware).SetLogger(logger)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("Traceparent", "00-"+traceID+"-"+parentID+"-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	request := logger.spans["dashmiddleware.request"]
+	if request == nil || request["trace_id"] != traceID || request["parent_id"] != parentID {
+		t.Fatalf("expected a request span continuing the trace, got %v", request)
+	}
+	for _, name := range []string{"dashmiddleware.backend.result", "dashmiddleware.downstream", "dashmiddleware.backend.track"} {
+		span := logger.spans[name]
+		if span == nil || span["trace_id"] != traceID || span["parent_id"] != request["span_id"] {
+			t.Errorf("expected a %s child span of the request span, got %v", name, span)
+		}
+	}
+
+	expected := map[string]string{
+		"dashmiddleware.downstream":     downstreamTraceparent,
+		"dashmiddleware.backend.result": backend.Calls("/result")[0].Header.Get("Traceparent"),
+		"dashmiddleware.backend.track":  backend.Calls("/track")[0].Header.Get("Traceparent"),
+	}
+	for name, traceparent := range expected {
+		if span := logger.spans[name]; span != nil && traceparent != "00-"+traceID+"-"+span["span_id"].(string)+"-01" {
+			t.Errorf("expected the callee of %s to continue from it, got %q", name, traceparent)
+		}
+	}
+}
+
+func TestTracingNotSampled(t *testing.T) {
+	const traceID, parentID = "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.TracingEnabled = true
+	handler := newHandler(t, cfg, nil)
+	logger := &spanLogger{}
+	handler.(*dashmiddleware.DashMiddleware).SetLogger(logger)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("Traceparent", "00-"+traceID+"-"+parentID+"-00")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(logger.spans) != 0 {
+		t.Errorf("expected no spans of a trace that is not sampled, got %v", logger.spans)
+	}
+	traceparent := backend.Calls("/result")[0].Header.Get("Traceparent")
+	if !strings.HasPrefix(traceparent, "00-"+traceID+"-") || !strings.HasSuffix(traceparent, "-00") {
+		t.Errorf("expected the callee to continue the trace without sampling it, got %q", traceparent)
+	}
+}
+
+func TestTracingExport(t *testing.T) {
+	const traceID, parentID = "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.TracingEnabled = true
+	cfg.TracingEndpoint = backend.URL + "/v1/traces"
+	handler := newHandler(t, cfg, nil)
+	logger := &spanLogger{}
+	middleware := handler.(*dashmiddleware.DashMiddleware)
+	middleware.SetLogger(logger)
+
+	req := newCallbackRequest(`{"input":1}`)
+	req.Header.Set("Traceparent", "00-"+traceID+"-"+parentID+"-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if err := middleware.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logger.spans) != 0 {
+		t.Errorf("expected the spans to be exported instead of logged, got %v", logger.spans)
+	}
+	var export struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Kind         int    `json:"kind"`
+					Attributes   []struct {
+						Key   string                 `json:"key"`
+						Value map[string]interface{} `json:"value"`
+					} `json:"attributes"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	exported := map[string]int{}
+	for _, call := range backend.Calls("/v1/traces") {
+		if call.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("expected an OTLP/HTTP JSON export, got %q", call.Header.Get("Content-Type"))
+		}
+		if err := json.Unmarshal(call.Body, &export); err != nil {
+			t.Fatal(err)
+		}
+		for _, resource := range export.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				for _, span := range scope.Spans {
+					if span.TraceID != traceID {
+						t.Errorf("expected the spans to continue the trace, got %q", span.TraceID)
+					}
+					exported[span.Name] = span.Kind
+					if span.Name == "dashmiddleware.request" {
+						if span.ParentSpanID != parentID || len(span.Attributes) == 0 || span.Attributes[0].Value["stringValue"] != http.MethodPost {
+							t.Errorf("expected the request span with its parent and attributes, got %+v", span)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for name, kind := range map[string]int{
+		"dashmiddleware.request":        2,
+		"dashmiddleware.downstream":     3,
+		"dashmiddleware.backend.result": 3,
+		"dashmiddleware.backend.track":  3,
+	} {
+		if got, found := exported[name]; !found || got != kind {
+			t.Errorf("expected %s to be exported with kind %d, got %d (%v)", name, kind, got, found)
+		}
+	}
+}
+
+func TestTracingExportBatches(t *testing.T) {
+	backend := newStubBackend(t)
+	cfg := backend.config()
+	cfg.TracingEnabled = true
+	cfg.TracingEndpoint = backend.URL + "/v1/traces"
+	handler := newHandler(t, cfg, nil)
+	middleware := handler.(*dashmiddleware.DashMiddleware)
+
+	for i := 1; i <= 20; i++ {
+		req := newCallbackRequest(fmt.Sprintf(`{"input":%d}`, i))
+		req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if n := len(backend.Calls("/v1/traces")); n != 0 {
+		t.Errorf("expected the spans to wait for a batch, got %d exports", n)
+	}
+
+	if err := middleware.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(backend.Calls("/v1/traces")); n != 1 {
+		t.Errorf("expected the pending spans to be exported together on close, got %d exports", n)
+	}
+}
+func TestInvalidTracingEndpoint(t *testing.T) {
+	cfg := newStubBackend(t).config()
+	cfg.TracingEndpoint = "collector:4318"
+	if _, err := dashmiddleware.New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil || !strings.Contains(err.Error(), "tracingendpoint") {
+		t.Errorf("expected the tracing endpoint to be rejected, got %v", err)
+	}
 }
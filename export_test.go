@@ -0,0 +1,8 @@
+package dashmiddleware
+
+import "time"
+
+// SetClock replaces the clock of the middleware, so tests control the time.
+func (c *DashMiddleware) SetClock(now func() time.Time) {
+	c.now = now
+}
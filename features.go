@@ -0,0 +1,25 @@
+package dashmiddleware
+
+// Experimental behaviors toggled through Config.Features.
+const (
+	// featureCoalesce shares one cache lookup between concurrent identical requests.
+	featureCoalesce = "coalesce"
+)
+
+var knownFeatures = map[string]bool{
+	featureCoalesce: true,
+}
+
+// checkFeatures warns about flags nothing reads, experiments come and go so they are not rejected.
+func checkFeatures(logger Logger, features map[string]bool) {
+	for name := range features {
+		if !knownFeatures[name] {
+			logger.Info("Ignoring unknown feature", "feature", name)
+		}
+	}
+}
+
+// feature reports whether an experimental behavior is enabled.
+func (c *DashMiddleware) feature(name string) bool {
+	return c.features[name]
+}
@@ -0,0 +1,72 @@
+package dashmiddleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+)
+
+// How form encoded request bodies end up in the track payload.
+const (
+	formBodyRaw      = "raw"
+	formBodyMetadata = "metadata"
+	formBodySkip     = "skip"
+)
+
+// FormField the metadata of a form field or uploaded file.
+type FormField struct {
+	Name     string `json:"name"`
+	FileName string `json:"filename,omitempty"`
+	Size     int    `json:"size"`
+}
+
+// isFormBody reports whether the request content type is a form encoding.
+func isFormBody(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data"
+}
+
+// formMetadata lists the fields of a form encoded body without their values.
+func formMetadata(contentType string, body []byte) ([]FormField, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []FormField{}
+	if mediaType == "application/x-www-form-urlencoded" {
+		values, parseErr := url.ParseQuery(string(body))
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		for name, entries := range values {
+			for _, entry := range entries {
+				fields = append(fields, FormField{Name: name, Size: len(entry)})
+			}
+		}
+		return fields, nil
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, partErr := reader.NextPart()
+		if errors.Is(partErr, io.EOF) {
+			return fields, nil
+		}
+		if partErr != nil {
+			return nil, partErr
+		}
+
+		size, copyErr := io.Copy(io.Discard, part)
+		if copyErr != nil {
+			return nil, copyErr
+		}
+		fields = append(fields, FormField{Name: part.FormName(), FileName: part.FileName(), Size: int(size)})
+	}
+}
@@ -0,0 +1,41 @@
+package dashmiddleware
+
+import "strings"
+
+// splitGroups returns the groups of the X-Auth-Request-Groups values, which may be comma joined.
+func splitGroups(values []string) []string {
+	var groups []string
+	for _, value := range values {
+		for _, group := range strings.Split(value, ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
+
+// containsAny reports whether one of the groups is listed.
+func containsAny(listed, groups []string) bool {
+	for _, group := range groups {
+		for _, candidate := range listed {
+			if group == candidate {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// groupsAllowed reports whether a user with the groups may access the recorded URLs.
+// A denied group wins over an allowed one, without allowed groups everyone not denied is.
+func (c *DashMiddleware) groupsAllowed(values []string) bool {
+	if len(c.allowedGroups) == 0 && len(c.deniedGroups) == 0 {
+		return true
+	}
+	groups := splitGroups(values)
+	if containsAny(c.deniedGroups, groups) {
+		return false
+	}
+	return len(c.allowedGroups) == 0 || containsAny(c.allowedGroups, groups)
+}
@@ -0,0 +1,88 @@
+package dashmiddleware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// grpcWebTrailerFlag marks a gRPC-Web frame that carries the trailers instead of a message.
+const grpcWebTrailerFlag = 0x80
+
+// isGrpcWeb reports whether the content type is one of the gRPC-Web variants.
+func isGrpcWeb(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/grpc-web")
+}
+
+// grpcWebStatus extracts the grpc-status of a gRPC-Web response. A trailers-only response, as most
+// errors are, has it in its headers, others in the trailer frame of the body, which is nil when not captured.
+func grpcWebStatus(header http.Header, body []byte) (int, bool) {
+	if value := header.Get("Grpc-Status"); value != "" {
+		status, err := strconv.Atoi(strings.TrimSpace(value))
+		return status, err == nil
+	}
+
+	if strings.HasPrefix(header.Get("Content-Type"), "application/grpc-web-text") {
+		decoded, err := decodeGrpcWebText(body)
+		if err != nil {
+			return 0, false
+		}
+		body = decoded
+	}
+
+	for len(body) >= 5 {
+		flag := body[0]
+		length := int(binary.BigEndian.Uint32(body[1:5]))
+		body = body[5:]
+		if length > len(body) {
+			return 0, false
+		}
+		frame := body[:length]
+		body = body[length:]
+
+		if flag&grpcWebTrailerFlag == 0 {
+			continue
+		}
+
+		for _, line := range strings.Split(string(frame), "\r\n") {
+			name, value, found := strings.Cut(line, ":")
+			if !found || !strings.EqualFold(strings.TrimSpace(name), "grpc-status") {
+				continue
+			}
+			status, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return 0, false
+			}
+			return status, true
+		}
+	}
+
+	return 0, false
+}
+
+// decodeGrpcWebText decodes a grpc-web-text body, the server may send every frame as a base64 chunk
+// with its own padding, so it is decoded chunk by chunk.
+func decodeGrpcWebText(text []byte) ([]byte, error) {
+	var decoded []byte
+	text = bytes.TrimSpace(text)
+	for len(text) > 0 {
+		end := len(text)
+		if i := bytes.IndexByte(text, '='); i >= 0 {
+			end = i
+			for end < len(text) && text[end] == '=' {
+				end++
+			}
+		}
+
+		chunk, err := base64.StdEncoding.DecodeString(string(text[:end]))
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, chunk...)
+		text = text[end:]
+	}
+	return decoded, nil
+}
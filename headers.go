@@ -0,0 +1,67 @@
+package dashmiddleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// cacheHeaders the response headers that describe how a result may be cached, tracked with it
+// so the backend can replay them with the cached result.
+var cacheHeaders = []string{"Cache-Control", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// responseCacheHeaders returns the cache headers a response has, nil when it has none.
+func responseCacheHeaders(header http.Header) map[string][]string {
+	var found map[string][]string
+	for _, name := range cacheHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			if found == nil {
+				found = map[string][]string{}
+			}
+			found[name] = values
+		}
+	}
+	return found
+}
+
+// responseTrailers returns the trailers a handler set, declared in the Trailer header
+// or set with the http.TrailerPrefix. It returns nil when there are none.
+func responseTrailers(header http.Header) http.Header {
+	var trailers http.Header
+	add := func(name string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		if trailers == nil {
+			trailers = http.Header{}
+		}
+		trailers[http.CanonicalHeaderKey(name)] = values
+	}
+
+	for _, declared := range header.Values("Trailer") {
+		for _, name := range strings.Split(declared, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				add(name, header.Values(name))
+			}
+		}
+	}
+	for key, values := range header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			add(strings.TrimPrefix(key, http.TrailerPrefix), values)
+		}
+	}
+	return trailers
+}
+
+// declareTrailers announces the trailers of a replayed response, before its header is written.
+func declareTrailers(header, trailers http.Header) {
+	for name := range trailers {
+		header.Add("Trailer", name)
+	}
+}
+
+// writeTrailers sets the values of the declared trailers, after the body was written.
+func writeTrailers(header, trailers http.Header) {
+	for name, values := range trailers {
+		header[name] = values
+	}
+}
@@ -0,0 +1,107 @@
+package dashmiddleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// defaultHealthPath where the health check is served when enabled.
+const defaultHealthPath = "/dashmiddleware/healthz"
+
+// healthStatus the JSON body of the health check.
+type healthStatus struct {
+	Status string            `json:"status"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// Healthy checks that the result, track, layout and poll backends are reachable with a HEAD request each.
+// A connection error or a 5xx of any of them makes it unhealthy.
+func (c *DashMiddleware) Healthy(ctx context.Context) error {
+	failures := c.checkBackends(ctx)
+	if len(failures) == 0 {
+		return nil
+	}
+
+	targets := make([]string, 0, len(failures))
+	for target := range failures {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	messages := make([]string, 0, len(targets))
+	for _, target := range targets {
+		messages = append(messages, fmt.Sprintf("%s backend: %s", target, failures[target]))
+	}
+	return fmt.Errorf("unhealthy: %s", strings.Join(messages, "; "))
+}
+
+// checkBackends pings every configured backend and returns the failures by target.
+func (c *DashMiddleware) checkBackends(ctx context.Context) map[string]string {
+	backends := map[string]string{
+		backendResult: c.resultURL,
+		backendTrack:  c.trackURL,
+		backendLayout: c.layoutURL,
+		backendPoll:   c.pollURL,
+	}
+	if !c.layoutEnabled {
+		delete(backends, backendLayout)
+	}
+
+	failures := map[string]string{}
+	for target, backendURL := range backends {
+		if backendURL == "" {
+			continue
+		}
+		if err := c.ping(ctx, backendURL); err != nil {
+			failures[target] = err.Error()
+		}
+	}
+	return failures
+}
+
+// ping sends a HEAD request to a backend, any answer but a 5xx means it is reachable.
+func (c *DashMiddleware) ping(ctx context.Context, backendURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, backendURL, http.NoBody)
+	if err != nil {
+		return err
+	}
+	c.authorize(req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	if closeErr := resp.Body.Close(); closeErr != nil {
+		c.logger.Debug("Failed to close response", "error", closeErr)
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// HealthHandler serves the health of the backends as JSON, with a 503 when one is unreachable.
+func (c *DashMiddleware) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx, cancel := c.withRequestTimeout(req.Context())
+		defer cancel()
+
+		status := healthStatus{Status: "ok"}
+		code := http.StatusOK
+		if failures := c.checkBackends(ctx); len(failures) > 0 {
+			status = healthStatus{Status: "unhealthy", Errors: failures}
+			code = http.StatusServiceUnavailable
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(code)
+		if err := json.NewEncoder(rw).Encode(status); err != nil {
+			c.logger.Debug("Failed to write the health status", "error", err)
+		}
+	})
+}
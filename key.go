@@ -0,0 +1,86 @@
+package dashmiddleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestKey identifies the cached result of a recorded request.
+func requestKey(url string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(url))
+	hash.Write([]byte{0})
+	hash.Write(body)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// cacheKey returns the request key within the configured key version.
+// Without a version the keys stay the unversioned ones, so enabling it is a deliberate invalidation.
+func (c *DashMiddleware) cacheKey(url string, body []byte) string {
+	key := requestKey(url, body)
+	if c.cacheKeyVersion == "" {
+		return key
+	}
+
+	hash := sha256.Sum256([]byte(c.cacheKeyVersion + "\x00" + key))
+	return hex.EncodeToString(hash[:])
+}
+
+// keyURL returns what the request key depends on besides the body: the URL with the lookup query
+// only, prefixed with the method unless it is a POST, so the keys of callbacks stay the same.
+func (c *DashMiddleware) keyURL(method string, requestURL *url.URL) string {
+	keyed := *requestURL
+	keyed.RawQuery = c.lookupQuery(requestURL.RawQuery)
+	if method == http.MethodPost {
+		return keyed.String()
+	}
+	return method + " " + keyed.String()
+}
+
+// lookupQuery returns the query sent with a result lookup, reduced to the LookupQueryParams when set.
+func (c *DashMiddleware) lookupQuery(rawQuery string) string {
+	if len(c.lookupQueryParams) == 0 {
+		return rawQuery
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// A malformed query is sent as is, the backend keys on more rather than less
+		return rawQuery
+	}
+	selected := url.Values{}
+	for _, param := range c.lookupQueryParams {
+		if values, ok := query[param]; ok {
+			selected[param] = values
+		}
+	}
+	return selected.Encode()
+}
+
+// varyKey extends a request key with the values of the request headers the response varies on.
+func varyKey(key string, header http.Header, vary []string) string {
+	if len(vary) == 0 {
+		return key
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(key))
+	for _, name := range vary {
+		hash.Write([]byte{0})
+		hash.Write([]byte(name + ":" + strings.Join(header.Values(name), ",")))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// idempotencyKey identifies one track event of a request across retries.
+func idempotencyKey(key string, timestamp time.Time) string {
+	hash := sha256.Sum256([]byte(key + "@" + strconv.FormatInt(timestamp.UnixNano(), 10)))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,130 @@
+package dashmiddleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Ways to handle a layout backend answering with an empty layout.
+const (
+	emptyLayoutPassthrough = "passthrough"
+	emptyLayoutFallback    = "fallback"
+	emptyLayoutError       = "error"
+)
+
+// defaultLayoutURLSuffix the endpoint Dash loads its layout from.
+const defaultLayoutURLSuffix = "/_dash-layout"
+
+// LayoutRequestData needed to get a layout from the backend server.
+type LayoutRequestData struct {
+	Email  []string `json:"email"`
+	Layout string   `json:"layout"`
+	Frame  string   `json:"frame"`
+}
+
+// layoutIdentifiers of a layout request body, newer Dash versions send them
+// there instead of in the referer.
+type layoutIdentifiers struct {
+	Layout string `json:"layout"`
+	Frame  string `json:"frame"`
+}
+
+// layoutFromBody returns the layout and frame named in a JSON request body,
+// empty when the body is not a JSON object naming them.
+func layoutFromBody(body []byte) (layout, frame string) {
+	var identifiers layoutIdentifiers
+	if err := json.Unmarshal(body, &identifiers); err != nil {
+		return "", ""
+	}
+	return identifiers.Layout, identifiers.Frame
+}
+
+// isLayoutRequest reports whether the request must be answered with a layout from the backend,
+// which needs the layout endpoint and a layout named in the referer or the body.
+func (c *DashMiddleware) isLayoutRequest(url, layout string) bool {
+	return layout != "" && c.isLayoutURL(url)
+}
+
+// isLayoutURL reports whether the URL is the layout endpoint handled by the middleware,
+// which it never is with the layout disabled.
+func (c *DashMiddleware) isLayoutURL(url string) bool {
+	return c.layoutEnabled && strings.HasSuffix(url, c.layoutURLSuffix)
+}
+
+// serveLayout answers a layout request with the layout from the backend.
+// It returns an error when the backend failed and nothing was written yet.
+func (c *DashMiddleware) serveLayout(ctx context.Context, responseWriter http.ResponseWriter, header http.Header, requestData LayoutRequestData) error {
+	// Serialize the request data to JSON
+	requestBody, err := json.Marshal(requestData)
+	if err != nil {
+		return fmt.Errorf("failed to serialize request data to JSON: %w", err)
+	}
+
+	// The layout call is bounded by its own timeout, within the one of the request
+	if c.layoutTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.layoutTimeout)
+		defer cancel()
+	}
+
+	layoutReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.layoutURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return fmt.Errorf("failed to create layout request: %w", err)
+	}
+	copyHeader(layoutReq.Header, header)
+	layoutReq.Header.Set("Content-Type", "application/json")
+	c.authorize(layoutReq)
+
+	resp, err := c.doBackend(backendLayout, layoutReq)
+	if err != nil {
+		return fmt.Errorf("failed to send request to layoutURL: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			c.logger.Debug("Failed to close response", "error", closeErr)
+		}
+	}()
+
+	// A failing layout backend is handled like the other backends, any other
+	// answer (e.g. a 404 for an unknown layout) is passed on to the client
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("failed to send request to layoutURL, status code: %d", resp.StatusCode)
+	}
+
+	// Copy the response from resp to responseWriter and return
+	layoutBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read layout body: %w", err)
+	}
+	contentType := resp.Header.Get("Content-Type")
+
+	// An empty layout renders a blank page without any error in the front-end
+	if resp.StatusCode == http.StatusOK && len(bytes.TrimSpace(layoutBody)) == 0 {
+		switch c.onEmptyLayout {
+		case emptyLayoutFallback:
+			c.logger.Info("Serving the fallback layout for an empty layout", "layout", requestData.Layout)
+			layoutBody = c.fallbackLayout
+			contentType = "application/json"
+		case emptyLayoutError:
+			c.logger.Error("The layout backend returned an empty layout", "layout", requestData.Layout)
+			http.Error(responseWriter, "the layout "+requestData.Layout+" is empty", http.StatusBadGateway)
+			return nil
+		}
+	}
+
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	responseWriter.Header().Set("Content-Type", contentType)
+	responseWriter.WriteHeader(resp.StatusCode)
+	_, err = responseWriter.Write(layoutBody)
+	if err != nil {
+		c.logger.Debug("Failed to send the layout to the client", "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package dashmiddleware
+
+import (
+	"fmt"
+	"time"
+)
+
+// startLifecycle drains the background work once the context given to New is cancelled,
+// which Traefik does when it stops the middleware.
+func (c *DashMiddleware) startLifecycle() {
+	if c.lifecycle.Done() == nil {
+		// A context that is never cancelled has nothing to wait for
+		return
+	}
+
+	go func() {
+		<-c.lifecycle.Done()
+		if err := c.Close(); err != nil {
+			c.logger.Error("Failed to close the middleware", "error", err)
+		}
+		close(c.drained)
+	}()
+}
+
+// Close stops the middleware from starting background work and waits for the running work,
+// including the queued track requests, up to the shutdown grace period. Track retries waiting
+// for their backoff are given up. It then closes the
+// idle backend connections and writes the local cache snapshot when configured.
+// Calling it again returns the result of the first call.
+func (c *DashMiddleware) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.shutdown()
+	})
+	return c.closeErr
+}
+
+func (c *DashMiddleware) shutdown() error {
+	c.backgroundMu.Lock()
+	c.draining = true
+	c.backgroundMu.Unlock()
+	// Waiting work, such as the backoff of a retry, ends right away
+	c.stop()
+
+	// The queued track requests are still sent before the workers stop
+	finished := make(chan struct{})
+	go func() {
+		c.flushTrackQueue()
+		c.background.Wait()
+		// The exporter stopped, the spans ended since its last export are still sent
+		c.sendSpans()
+		close(finished)
+	}()
+
+	var err error
+	var grace <-chan time.Time
+	if c.shutdownGracePeriod > 0 {
+		timer := time.NewTimer(c.shutdownGracePeriod)
+		defer timer.Stop()
+		grace = timer.C
+	}
+	select {
+	case <-finished:
+	case <-grace:
+		err = fmt.Errorf("background work still running after the shutdown grace period of %s", c.shutdownGracePeriod)
+	}
+
+	c.client.CloseIdleConnections()
+
+	if snapshotErr := c.saveSnapshot(); snapshotErr != nil && err == nil {
+		err = snapshotErr
+	}
+	return err
+}
+
+// goBackground runs work after the response was served, unless the middleware is draining.
+func (c *DashMiddleware) goBackground(work func()) {
+	c.backgroundMu.Lock()
+	defer c.backgroundMu.Unlock()
+	if c.draining {
+		return
+	}
+
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		work()
+	}()
+}
+
+// Drained is closed once the background work finished, or the shutdown grace period ran out, after the context given to New was cancelled,
+// it is never closed for a context that cannot be cancelled.
+func (c *DashMiddleware) Drained() <-chan struct{} {
+	return c.drained
+}
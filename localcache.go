@@ -0,0 +1,123 @@
+package dashmiddleware
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localCacheEntry a cached result kept in memory.
+type localCacheEntry struct {
+	key  string
+	resp *backendResponse
+	// expiresAt is when the entry is no longer served, the zero time keeps it until evicted.
+	expiresAt time.Time
+}
+
+// localCache an in-memory LRU of cached results in front of the result backend,
+// bounded by the bytes of the stored bodies rather than the number of entries.
+type localCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func newLocalCache(maxBytes int) *localCache {
+	return &localCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// get returns the cached result of a key, the response must be treated as read-only.
+// An expired entry is evicted and reported as missing.
+func (l *localCache) get(key string, now time.Time) (*backendResponse, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, found := l.entries[key]
+	if !found {
+		return nil, false
+	}
+	if expiresAt := element.Value.(*localCacheEntry).expiresAt; !expiresAt.IsZero() && !now.Before(expiresAt) {
+		l.remove(element)
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return element.Value.(*localCacheEntry).resp, true
+}
+
+// add stores a result, evicting the least recently used ones until it fits the budget.
+// A result larger than the whole budget is not stored.
+func (l *localCache) add(key string, resp *backendResponse, expiresAt time.Time) {
+	if len(resp.Body) > l.maxBytes {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if element, found := l.entries[key]; found {
+		l.remove(element)
+	}
+	l.entries[key] = l.order.PushFront(&localCacheEntry{key: key, resp: resp, expiresAt: expiresAt})
+	l.size += len(resp.Body)
+
+	for l.size > l.maxBytes {
+		l.remove(l.order.Back())
+	}
+}
+
+func (l *localCache) remove(element *list.Element) {
+	entry := l.order.Remove(element).(*localCacheEntry)
+	delete(l.entries, entry.key)
+	l.size -= len(entry.resp.Body)
+}
+
+// snapshot returns the entries from the least to the most recently used.
+func (l *localCache) snapshot() []*localCacheEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]*localCacheEntry, 0, len(l.entries))
+	for element := l.order.Back(); element != nil; element = element.Prev() {
+		entries = append(entries, element.Value.(*localCacheEntry))
+	}
+	return entries
+}
+
+// localCacheExpiry returns when a result expires from the local cache, false when it must not be stored.
+// The max-age or Expires of the result backend come first, then the cache TTL of the frame.
+// The zero time keeps the result until it is evicted.
+func (c *DashMiddleware) localCacheExpiry(resp *backendResponse, frame string, now time.Time) (time.Time, bool) {
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+		switch name {
+		case "no-store", "no-cache":
+			return time.Time{}, false
+		case "max-age":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || seconds <= 0 {
+				return time.Time{}, false
+			}
+			return now.Add(time.Duration(seconds) * time.Second), true
+		}
+	}
+	if expires := resp.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil || !expiresAt.After(now) {
+			return time.Time{}, false
+		}
+		return expiresAt, true
+	}
+	if ttl := c.cacheTTL(frame); ttl > 0 {
+		return now.Add(ttl), true
+	}
+	return time.Time{}, true
+}
@@ -0,0 +1,74 @@
+package dashmiddleware
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives the log lines of the middleware, fields are alternating keys and values.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// Supported values for LogLevel.
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelError = "error"
+)
+
+var logLevels = map[string]int{logLevelDebug: 0, logLevelInfo: 1, logLevelError: 2}
+
+// stdLogger writes the lines at or above its level to the standard logger, which Traefik collects.
+type stdLogger struct {
+	level int
+}
+
+func newStdLogger(level string) (*stdLogger, error) {
+	if level == "" {
+		level = logLevelInfo
+	}
+	rank, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("invalid loglevel %q, expected %q, %q or %q", level, logLevelDebug, logLevelInfo, logLevelError)
+	}
+	return &stdLogger{level: rank}, nil
+}
+
+func (l *stdLogger) Debug(msg string, fields ...interface{}) { l.print(logLevelDebug, msg, fields) }
+func (l *stdLogger) Info(msg string, fields ...interface{})  { l.print(logLevelInfo, msg, fields) }
+func (l *stdLogger) Error(msg string, fields ...interface{}) { l.print(logLevelError, msg, fields) }
+
+// print formats a line as level=... msg="..." key=value, quoting the strings.
+func (l *stdLogger) print(level, msg string, fields []interface{}) {
+	if logLevels[level] < l.level {
+		return
+	}
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "level=%s msg=%q", level, msg)
+	for i := 0; i < len(fields); i += 2 {
+		var value interface{} = "MISSING"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		switch v := value.(type) {
+		case string:
+			fmt.Fprintf(&line, " %v=%q", fields[i], v)
+		case error:
+			fmt.Fprintf(&line, " %v=%q", fields[i], v.Error())
+		default:
+			fmt.Fprintf(&line, " %v=%v", fields[i], v)
+		}
+	}
+	log.Print(line.String())
+}
+
+// SetLogger replaces the logger of the middleware, it must be called before serving requests.
+// The given logger does its own level filtering, LogLevel only applies to the default one.
+func (c *DashMiddleware) SetLogger(logger Logger) {
+	c.logger = logger
+}
@@ -0,0 +1,66 @@
+package dashmiddleware
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultLongCallbackHeader the header marking a callback as long running.
+const defaultLongCallbackHeader = "X-Longcallback"
+
+// pendingJobs the long callbacks submitted per user and key, so duplicates are not queued again.
+type pendingJobs struct {
+	mu      sync.Mutex
+	entries map[string]pendingJob
+	window  time.Duration
+}
+
+// pendingJob a submitted long callback and the ID it is polled with, if any.
+type pendingJob struct {
+	submitted time.Time
+	jobID     string
+}
+
+func newPendingJobs(window time.Duration) *pendingJobs {
+	if window <= 0 {
+		return nil
+	}
+	return &pendingJobs{entries: map[string]pendingJob{}, window: window}
+}
+
+// claim marks a job as submitted and returns false when it already is, together with the ID
+// of the pending job.
+func (p *pendingJobs) claim(id, jobID string, now time.Time) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pending, ok := p.entries[id]; ok && now.Sub(pending.submitted) < p.window {
+		return pending.jobID, false
+	}
+
+	for pending, job := range p.entries {
+		if now.Sub(job.submitted) >= p.window {
+			delete(p.entries, pending)
+		}
+	}
+	p.entries[id] = pendingJob{submitted: now, jobID: jobID}
+	return jobID, true
+}
+
+// setJobID replaces the ID a pending job is polled with, e.g. by the one of the backend.
+func (p *pendingJobs) setJobID(id, jobID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pending, ok := p.entries[id]; ok {
+		pending.jobID = jobID
+		p.entries[id] = pending
+	}
+}
+
+// release forgets a job, e.g. because its result is available.
+func (p *pendingJobs) release(id string) {
+	p.mu.Lock()
+	delete(p.entries, id)
+	p.mu.Unlock()
+}
@@ -0,0 +1,202 @@
+package dashmiddleware
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultMetricsPath where the metrics are served when enabled.
+const defaultMetricsPath = "/dashmiddleware/metrics"
+
+// defaultBuckets the upper bounds in seconds of the latency histograms, as Prometheus defaults them.
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram a cumulative latency histogram of one series.
+type histogram struct {
+	name   string
+	labels string
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+// metrics in-process counters and histograms keyed by name and label pairs.
+type metrics struct {
+	mu         sync.Mutex
+	counters   map[string]int64
+	histograms map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{counters: map[string]int64{}, histograms: map[string]*histogram{}}
+}
+
+// labelValueEscaper escapes label values as the Prometheus text format requires.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats label pairs the way Prometheus does, without the braces.
+func formatLabels(labels ...string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelValueEscaper.Replace(labels[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// metricKey formats a metric name and its label pairs the way Prometheus does.
+func metricKey(name string, labels ...string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	return name + "{" + formatLabels(labels...) + "}"
+}
+
+func (m *metrics) inc(name string, labels ...string) {
+	key := metricKey(name, labels...)
+
+	m.mu.Lock()
+	m.counters[key]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) counter(name string, labels ...string) int64 {
+	key := metricKey(name, labels...)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[key]
+}
+
+// observe records a value in seconds in the histogram of the series.
+func (m *metrics) observe(name string, value float64, labels ...string) {
+	key := metricKey(name, labels...)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, found := m.histograms[key]
+	if !found {
+		h = &histogram{name: name, labels: formatLabels(labels...), counts: make([]int64, len(defaultBuckets))}
+		m.histograms[key] = h
+	}
+	for i, bound := range defaultBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// writeText writes all series in the Prometheus text exposition format.
+func (m *metrics) writeText(w http.ResponseWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counterKeys := make([]string, 0, len(m.counters))
+	for key := range m.counters {
+		counterKeys = append(counterKeys, key)
+	}
+	sort.Strings(counterKeys)
+	typed := map[string]bool{}
+	for _, key := range counterKeys {
+		name := key
+		if i := strings.IndexByte(key, '{'); i >= 0 {
+			name = key[:i]
+		}
+		if !typed[name] {
+			typed[name] = true
+			fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		}
+		fmt.Fprintf(w, "%s %d\n", key, m.counters[key])
+	}
+
+	histogramKeys := make([]string, 0, len(m.histograms))
+	for key := range m.histograms {
+		histogramKeys = append(histogramKeys, key)
+	}
+	sort.Strings(histogramKeys)
+	for _, key := range histogramKeys {
+		h := m.histograms[key]
+		if !typed[h.name] {
+			typed[h.name] = true
+			fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+		}
+		prefix := ""
+		if h.labels != "" {
+			prefix = h.labels + ","
+		}
+		for i, bound := range defaultBuckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, braces(h.labels), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, braces(h.labels), h.count)
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// labelLimiter bounds the cardinality of a label, values past the limit are reported as other.
+type labelLimiter struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]bool
+}
+
+func newLabelLimiter(max int) *labelLimiter {
+	return &labelLimiter{max: max, seen: map[string]bool{}}
+}
+
+func (l *labelLimiter) label(value string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seen[value] {
+		return value
+	}
+	if len(l.seen) >= l.max {
+		return "other"
+	}
+	l.seen[value] = true
+	return value
+}
+
+// frameLabelRegex the frames labelling a series on their own, the frame comes from the client's Referer.
+var frameLabelRegex = regexp.MustCompile(`^[A-Za-z0-9_.\-]{0,64}$`)
+
+// frameLabel the label of a frame, configured frames are always their own label.
+// Other frames are only admitted by the labelLimiter when they look like a frame name,
+// so a client cannot fill its slots with junk.
+func (c *DashMiddleware) frameLabel(frame string) string {
+	if _, configured := c.frameCacheTTLs[frame]; configured {
+		return frame
+	}
+	if !frameLabelRegex.MatchString(frame) {
+		return "other"
+	}
+	return c.frameLabels.label(frame)
+}
+
+// Counter returns the current value of a counter, labels are given as name/value pairs.
+func (c *DashMiddleware) Counter(name string, labels ...string) int64 {
+	return c.metrics.counter(name, labels...)
+}
+
+// MetricsHandler serves the counters and histograms in the Prometheus text format.
+func (c *DashMiddleware) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.metrics.writeText(rw)
+	})
+}
@@ -0,0 +1,56 @@
+package dashmiddleware
+
+import (
+	"math/rand"
+	"net/http"
+)
+
+// sampleNonRecorded decides whether a request that is not recorded is tracked anyway.
+func (c *DashMiddleware) sampleNonRecorded() bool {
+	return c.trackNonRecorded && c.nonRecordedSampleRate > 0 && rand.Float64() < c.nonRecordedSampleRate
+}
+
+// serveNonRecorded passes a request that is not recorded through and tracks its metadata.
+// Neither the request nor the response body is kept, and nothing is cached.
+func (c *DashMiddleware) serveNonRecorded(w http.ResponseWriter, req *http.Request, rec *recordedRequest) {
+	capturingWriter := &CapturingResponseWriter{ResponseWriter: w, skipBody: true}
+	c.next.ServeHTTP(capturingWriter, req)
+
+	statusCode := capturingWriter.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	duration := c.now().Sub(rec.startTime).Seconds()
+
+	payload := map[string]interface{}{
+		"URL":         rec.url,
+		"Method":      req.Method,
+		"Email":       c.trackedEmail(rec.email),
+		"Groups":      rec.groups,
+		"Frame":       rec.frame,
+		"Duration":    duration,
+		"RefererBase": rec.refererBase,
+		"RemoteAddr":  rec.remoteAddr,
+		"UserAgent":   rec.userAgent,
+		"Aborted":     capturingWriter.Err != nil,
+		"StatusCode":  statusCode,
+		"Recorded":    false,
+		"Cacheable":   false,
+	}
+	if len(rec.traefik) > 0 {
+		payload["Traefik"] = rec.traefik
+	}
+	if rec.sessionID != "" {
+		payload["SessionID"] = rec.sessionID
+	}
+	if c.includeReferer {
+		payload["Referer"] = c.redactReferer(rec.referer)
+	}
+
+	trackHeader := http.Header{}
+	copyHeader(trackHeader, rec.propagated)
+	trackHeader.Set("Content-Type", "application/json")
+	trackHeader.Set("Idempotency-Key", idempotencyKey(requestKey(req.Method+" "+rec.url, nil), rec.startTime))
+
+	c.track(c.trackURLFor(false, rec.frame), payload, trackHeader)
+}
@@ -0,0 +1,166 @@
+package dashmiddleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Bounds of the spans waiting to be exported.
+const (
+	// spanBatchSize spans are exported together at the latest.
+	spanBatchSize = 512
+	// maxPendingSpans further spans are dropped while the tracing endpoint is slow.
+	maxPendingSpans = 4096
+	// spanExportInterval the pending spans wait at most for an export.
+	spanExportInterval = 5 * time.Second
+)
+
+// Kinds of the exported spans, as numbered by OTLP.
+const (
+	otlpSpanKindServer = 2
+	otlpSpanKindClient = 3
+)
+
+// otlpSpan a finished span in the OTLP/HTTP JSON encoding.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// otlpValue encodes an attribute value as an OTLP AnyValue.
+func otlpValue(value interface{}) map[string]interface{} {
+	switch value := value.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": value}
+	case bool:
+		return map[string]interface{}{"boolValue": value}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": value}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+}
+
+// exportSpan queues a finished span for the tracing endpoint. The exporter sends the spans
+// periodically, or right away once a batch is full, so the response is not delayed.
+func (c *DashMiddleware) exportSpan(s *span, end time.Time) {
+	exported := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              otlpSpanKindClient,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.name == spanRequest {
+		exported.Kind = otlpSpanKindServer
+	}
+	for i := 0; i+1 < len(s.fields); i += 2 {
+		exported.Attributes = append(exported.Attributes, otlpAttribute{Key: fmt.Sprint(s.fields[i]), Value: otlpValue(s.fields[i+1])})
+	}
+
+	c.spansMu.Lock()
+	if len(c.pendingSpans) >= maxPendingSpans {
+		c.spansMu.Unlock()
+		c.metrics.inc("dashmiddleware_spans_dropped_total")
+		return
+	}
+	c.pendingSpans = append(c.pendingSpans, exported)
+	full := len(c.pendingSpans) >= spanBatchSize
+	c.spansMu.Unlock()
+
+	if full {
+		// The exporter may already be told about a full batch
+		select {
+		case c.spansFull <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runSpanExporter sends the pending spans every spanExportInterval and whenever a batch is full,
+// one export at a time. The spans left when the middleware is closed are sent by Close.
+func (c *DashMiddleware) runSpanExporter() {
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sendSpans()
+		case <-c.spansFull:
+			c.sendSpans()
+		case <-c.stopping.Done():
+			return
+		}
+	}
+}
+
+// sendSpans exports the pending spans to the tracing endpoint.
+func (c *DashMiddleware) sendSpans() {
+	c.spansMu.Lock()
+	spans := c.pendingSpans
+	c.pendingSpans = nil
+	c.spansMu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue("dashmiddleware")}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/dashpool/dashmiddleware"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		c.logger.Error("Failed to marshal the spans", "error", err)
+		return
+	}
+
+	// Sent on shutdown too, so the export is not bound to the lifecycle
+	ctx, cancel := c.withRequestTimeout(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tracingEndpoint, bytes.NewReader(payload))
+	if err != nil {
+		c.logger.Error("Failed to create the span export request", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Not through doBackend, an export must not produce spans of its own
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.logger.Error("Failed to export the spans", "error", err, "spans", len(spans))
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		c.logger.Error("Failed to export the spans", "status", resp.StatusCode, "spans", len(spans))
+	}
+}
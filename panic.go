@@ -0,0 +1,50 @@
+package dashmiddleware
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+)
+
+// maxPanicStackBytes bounds the stack tracked for a panic, the top frames are the interesting ones.
+const maxPanicStackBytes = 4 << 10
+
+var emailRegexp = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// downstreamPanic a panic of the downstream handler carried over from the goroutine it happened on.
+type downstreamPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// recordPanic keeps the details of a panic for tracking and lets it go on with its original value.
+// It has to be deferred, so it runs before the deferred tracking.
+func (c *DashMiddleware) recordPanic(rec *recordedRequest) {
+	p := recover()
+	if p == nil {
+		return
+	}
+
+	var stack []byte
+	if carried, ok := p.(*downstreamPanic); ok {
+		p, stack = carried.value, carried.stack
+	}
+	// The deliberate abort of a response, e.g. by a ReverseProxy whose client went away, is no failure of the app
+	if p == http.ErrAbortHandler {
+		rec.aborted = true
+		panic(p)
+	}
+	if stack == nil {
+		stack = debug.Stack()
+	}
+	if len(stack) > maxPanicStackBytes {
+		stack = stack[:maxPanicStackBytes]
+	}
+
+	// Panic values tend to include user input
+	rec.panicMessage = emailRegexp.ReplaceAllString(fmt.Sprint(p), "REDACTED")
+	rec.panicStack = emailRegexp.ReplaceAllString(string(stack), "REDACTED")
+
+	panic(p)
+}
@@ -0,0 +1,117 @@
+package dashmiddleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Polling of long callbacks: the 202 of a long callback carries the poll URL of its job in
+// the Location header. A GET to it asks the poll backend, which answers a 202 while the job
+// is pending and a 200 with the result once it is done.
+const (
+	// pollJobParam the query param of the poll URL naming the job.
+	pollJobParam = "job"
+	// jobIDHeader lets the result backend name the job of a long callback, overriding the generated ID.
+	jobIDHeader = "X-Job-Id"
+)
+
+// newJobID generates the ID of a long callback job, the result backend gets it in the lookup payload.
+func newJobID() string {
+	return randomHex(16)
+}
+
+// pollLocation the URL a long callback job is polled on.
+func (c *DashMiddleware) pollLocation(jobID string) string {
+	return c.pollPath + "?" + pollJobParam + "=" + url.QueryEscape(jobID)
+}
+
+// servePoll answers a poll for a long callback job with the answer of the poll backend.
+func (c *DashMiddleware) servePoll(ctx context.Context, responseWriter http.ResponseWriter, req *http.Request, email []string, header http.Header) {
+	if req.Method != http.MethodGet {
+		http.Error(responseWriter, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	jobID := req.URL.Query().Get(pollJobParam)
+	if jobID == "" {
+		http.Error(responseWriter, "missing job", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := c.sendPoll(ctx, jobID, email, header)
+	if err != nil {
+		c.logger.Error("Failed to poll the long callback", "job", jobID, "error", err)
+		// The poll call is bounded by the request timeout only
+		if stage := timeoutStage(ctx, err, timeoutStageRequest); stage != "" {
+			c.timedOut(responseWriter, stage)
+			return
+		}
+		http.Error(responseWriter, "backend unavailable", http.StatusBadGateway)
+		return
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		responseWriter.Header().Set("Location", c.pollLocation(jobID))
+		responseWriter.WriteHeader(http.StatusAccepted)
+	case resp.StatusCode == http.StatusOK:
+		// The result is served like a cached one
+		for key, values := range resp.Header {
+			if key == "Transfer-Encoding" || key == "Connection" || key == "Content-Length" {
+				continue
+			}
+			for _, value := range values {
+				responseWriter.Header().Add(key, value)
+			}
+		}
+		responseWriter.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+		responseWriter.WriteHeader(http.StatusOK)
+		if _, err := responseWriter.Write(resp.Body); err != nil {
+			c.logger.Debug("Failed to send the polled result", "error", err)
+		}
+	case resp.StatusCode == http.StatusNotFound:
+		http.Error(responseWriter, "unknown job", http.StatusNotFound)
+	default:
+		c.logger.Error("Failed to poll the long callback", "job", jobID, "status", resp.StatusCode)
+		http.Error(responseWriter, "backend unavailable", http.StatusBadGateway)
+	}
+}
+
+// sendPoll asks the poll backend for the state of a job.
+func (c *DashMiddleware) sendPoll(ctx context.Context, jobID string, email []string, header http.Header) (*backendResponse, error) {
+	payloadJSON, err := json.Marshal(map[string]interface{}{
+		"JobID": jobID,
+		"Email": email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.pollURL, bytes.NewBuffer(payloadJSON))
+	if err != nil {
+		return nil, err
+	}
+	copyHeader(req.Header, header)
+	req.Header.Set("Content-Type", "application/json")
+	c.authorize(req)
+
+	resp, err := c.doBackend(backendPoll, req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			c.logger.Debug("Failed to close response", "error", closeErr)
+		}
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &backendResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}, nil
+}
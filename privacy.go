@@ -0,0 +1,74 @@
+package dashmiddleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// defaultEmailHeader the header oauth2-proxy passes the user email in.
+const defaultEmailHeader = "X-Auth-Request-Email"
+
+// requestEmail returns the values of the first configured email header that has any.
+func (c *DashMiddleware) requestEmail(header http.Header) []string {
+	for _, name := range c.emailHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			return values
+		}
+	}
+	return nil
+}
+
+// requestSession returns the session ID of a request, from the session header or else the session cookie.
+func (c *DashMiddleware) requestSession(req *http.Request) string {
+	if c.sessionHeader != "" {
+		if session := req.Header.Get(c.sessionHeader); session != "" {
+			return session
+		}
+	}
+	if c.sessionCookie != "" {
+		if cookie, err := req.Cookie(c.sessionCookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// Supported values for EmailHasher.
+const emailHasherHMAC = "hmac-sha256"
+
+// newEmailHasher returns the function pseudonymizing tracked emails, nil keeps them as they are.
+func newEmailHasher(name, secret string) (func(string) string, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case emailHasherHMAC:
+		if secret == "" {
+			return nil, errors.New("emailhasher hmac-sha256 requires an emailhashsecret")
+		}
+		key := []byte(secret)
+		return func(email string) string {
+			mac := hmac.New(sha256.New, key)
+			mac.Write([]byte(email))
+			return hex.EncodeToString(mac.Sum(nil))
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid emailhasher %q, expected %q", name, emailHasherHMAC)
+	}
+}
+
+// trackedEmail pseudonymizes the emails sent to the analytics backend.
+func (c *DashMiddleware) trackedEmail(email []string) []string {
+	if c.emailHasher == nil {
+		return email
+	}
+
+	hashed := make([]string, len(email))
+	for i, address := range email {
+		hashed[i] = c.emailHasher(address)
+	}
+	return hashed
+}
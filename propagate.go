@@ -0,0 +1,26 @@
+package dashmiddleware
+
+import "net/http"
+
+// defaultPropagateHeaders the tracing and correlation headers passed on to the backend calls.
+var defaultPropagateHeaders = []string{"traceparent", "tracestate", "X-Request-Id"}
+
+// propagatedHeaders returns the headers of a request that are passed on to the backend calls.
+func (c *DashMiddleware) propagatedHeaders(header http.Header) http.Header {
+	propagated := http.Header{}
+	for _, name := range c.propagateHeaders {
+		for _, value := range header.Values(name) {
+			propagated.Add(name, value)
+		}
+	}
+	return propagated
+}
+
+// copyHeader adds all values of src to dst.
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
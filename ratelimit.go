@@ -0,0 +1,117 @@
+package dashmiddleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRateLimitBuckets bounds the number of users tracked before idle buckets are pruned.
+const maxRateLimitBuckets = 10000
+
+// tokenBucket the remaining requests of one user.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter per user token buckets, the rate of a request depends on its groups.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+
+	rate       float64
+	groupRates map[string]float64
+	burst      int
+}
+
+func newRateLimiter(rate float64, groupRates map[string]float64, burst int) *rateLimiter {
+	if rate <= 0 && len(groupRates) == 0 {
+		return nil
+	}
+	return &rateLimiter{
+		buckets:    map[string]*tokenBucket{},
+		rate:       rate,
+		groupRates: groupRates,
+		burst:      burst,
+	}
+}
+
+// rateFor returns the most permissive rate of the groups, or the default rate.
+func (l *rateLimiter) rateFor(groups []string) float64 {
+	rate := -1.0
+	for _, value := range groups {
+		for _, group := range strings.Split(value, ",") {
+			if groupRate, ok := l.groupRates[strings.TrimSpace(group)]; ok && groupRate > rate {
+				rate = groupRate
+			}
+		}
+	}
+	if rate < 0 {
+		return l.rate
+	}
+	return rate
+}
+
+// allow takes a token of the user and reports how long to wait when there is none.
+func (l *rateLimiter) allow(user string, groups []string, now time.Time) (bool, time.Duration) {
+	rate := l.rateFor(groups)
+	if rate <= 0 {
+		return true, 0
+	}
+	capacity := float64(l.burst)
+	if capacity < 1 {
+		capacity = math.Max(1, math.Ceil(rate))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[user]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[user] = bucket
+	}
+
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// prune drops the buckets of users that were idle for a minute, they would be full again anyway.
+func (l *rateLimiter) prune(now time.Time) {
+	for user, bucket := range l.buckets {
+		if now.Sub(bucket.last) > time.Minute {
+			delete(l.buckets, user)
+		}
+	}
+}
+
+// rateLimited answers with a 429 when the user exceeded its rate limit.
+func (c *DashMiddleware) rateLimited(responseWriter http.ResponseWriter, email, groups []string) bool {
+	if c.rateLimiter == nil {
+		return false
+	}
+
+	allowed, wait := c.rateLimiter.allow(strings.Join(email, ","), groups, c.now())
+	if allowed {
+		return false
+	}
+
+	c.metrics.inc("dashmiddleware_rate_limited_total")
+	responseWriter.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(responseWriter, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return true
+}
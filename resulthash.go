@@ -0,0 +1,37 @@
+package dashmiddleware
+
+import (
+	"crypto/sha1" //nolint:gosec // only identifies results, no security property relies on it
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+)
+
+// Supported values for HashAlgorithm.
+const (
+	hashSHA256 = "sha256"
+	hashSHA1   = "sha1"
+	hashNone   = "none"
+)
+
+// newResultHasher returns the constructor of the hash of tracked results, nil when they are not hashed.
+func newResultHasher(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case hashSHA256, "":
+		return sha256.New, nil
+	case hashSHA1:
+		return sha1.New, nil
+	case hashNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid hashalgorithm %q, expected %q, %q or %q", algorithm, hashSHA256, hashSHA1, hashNone)
+	}
+}
+
+// resultHash returns the hex encoded hash of a captured result.
+func (c *DashMiddleware) resultHash(body []byte) string {
+	hasher := c.resultHasher()
+	hasher.Write(body)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
@@ -0,0 +1,95 @@
+package dashmiddleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotEntry a local cache entry as written to the snapshot file.
+type snapshotEntry struct {
+	Key     string      `json:"key"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Trailer http.Header `json:"trailer,omitempty"`
+	Expires time.Time   `json:"expires,omitempty"`
+}
+
+// loadLocalCacheSnapshot fills the local cache from the snapshot file.
+// A missing file is a cold start, corrupt and expired entries are skipped.
+func loadLocalCacheSnapshot(path string, cache *localCache, now time.Time, logger Logger) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the local cache snapshot: %w", err)
+	}
+
+	var entries []snapshotEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		logger.Error("Ignoring corrupt local cache snapshot", "path", path, "error", err)
+		return nil
+	}
+
+	// The entries are written from the least to the most recently used
+	for _, entry := range entries {
+		if entry.Key == "" {
+			continue
+		}
+		// Snapshots written before the entries had an expiry only have the Expires header
+		expiresAt := entry.Expires
+		if expires := entry.Header.Get("Expires"); expiresAt.IsZero() && expires != "" {
+			var err error
+			if expiresAt, err = http.ParseTime(expires); err != nil {
+				continue
+			}
+		}
+		if !expiresAt.IsZero() && !expiresAt.After(now) {
+			continue
+		}
+		cache.add(entry.Key, &backendResponse{StatusCode: http.StatusOK, Header: entry.Header, Body: entry.Body, Trailer: entry.Trailer}, expiresAt)
+	}
+	return nil
+}
+
+// saveLocalCacheSnapshot writes the local cache entries to the snapshot file.
+// It writes a temporary file first, so a crash never leaves a truncated snapshot behind.
+func saveLocalCacheSnapshot(path string, cache *localCache) error {
+	cached := cache.snapshot()
+	entries := make([]snapshotEntry, 0, len(cached))
+	for _, entry := range cached {
+		entries = append(entries, snapshotEntry{Key: entry.key, Header: entry.resp.Header, Body: entry.resp.Body, Trailer: entry.resp.Trailer, Expires: entry.expiresAt})
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the local cache snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write the local cache snapshot: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write the local cache snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write the local cache snapshot: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// saveSnapshot writes the local cache snapshot when configured.
+func (c *DashMiddleware) saveSnapshot() error {
+	if c.localCacheSnapshotPath == "" || c.localCache == nil {
+		return nil
+	}
+	return saveLocalCacheSnapshot(c.localCacheSnapshotPath, c.localCache)
+}
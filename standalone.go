@@ -0,0 +1,23 @@
+package dashmiddleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// NewStandalone creates the middleware in front of a reverse proxy to the upstream,
+// to run it without Traefik.
+func NewStandalone(upstream string, config *Config) (http.Handler, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %w", upstream, err)
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid upstream %q: scheme and host are required", upstream)
+	}
+
+	return New(context.Background(), httputil.NewSingleHostReverseProxy(target), config, "dashmiddleware-standalone")
+}
@@ -0,0 +1,258 @@
+package dashmiddleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Stages reported as TimeoutStage when a deadline fires.
+const (
+	timeoutStageResultLookup = "resultLookup"
+	timeoutStageDownstream   = "downstream"
+	timeoutStageLayout       = "layout"
+	// timeoutStageRequest the RequestTimeout bounding all the backend calls of a request.
+	timeoutStageRequest = "request"
+)
+
+// Ways to handle a result lookup that timed out.
+const (
+	resultTimeoutFailClosed = "fail-closed"
+	resultTimeoutMiss       = "miss"
+)
+
+// bufferedResponseWriter holds a downstream response until it is known to be in time.
+type bufferedResponseWriter struct {
+	mu         sync.Mutex
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+	timedOut   bool
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(statusCode int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timedOut || w.statusCode != 0 {
+		return
+	}
+	w.statusCode = statusCode
+}
+
+// streamingTimeoutWriter passes a streamed downstream response on as it is written, until the deadline.
+// The handler has a header of its own, so it cannot touch the response once it timed out.
+type streamingTimeoutWriter struct {
+	mu       sync.Mutex
+	w        http.ResponseWriter
+	deadline context.Context
+	header   http.Header
+	started  bool
+	timedOut bool
+}
+
+func (w *streamingTimeoutWriter) Header() http.Header {
+	return w.header
+}
+
+// expired reports whether the deadline passed, it must be called with mu held.
+// The handler may see the deadline before serveDownstream does, nothing gets through after it anyway.
+func (w *streamingTimeoutWriter) expired() bool {
+	if w.deadline.Err() != nil {
+		w.timedOut = true
+	}
+	return w.timedOut
+}
+
+// start sends the header of the handler, it must be called with mu held.
+func (w *streamingTimeoutWriter) start(statusCode int) {
+	if w.started {
+		return
+	}
+	w.started = true
+	for key, values := range w.header {
+		w.w.Header()[key] = values
+	}
+	w.w.WriteHeader(statusCode)
+}
+
+func (w *streamingTimeoutWriter) WriteHeader(statusCode int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.expired() {
+		w.start(statusCode)
+	}
+}
+
+func (w *streamingTimeoutWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.expired() {
+		return 0, http.ErrHandlerTimeout
+	}
+	w.start(http.StatusOK)
+	return w.w.Write(b)
+}
+
+func (w *streamingTimeoutWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.expired() {
+		return
+	}
+	w.start(http.StatusOK)
+	if flusher, ok := w.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// serveDownstream runs the next handler, bounded by the downstream timeout when configured.
+// A buffered response is only written to w once it is in time. A streamed one is written as it
+// comes and cut off at the deadline, so it keeps streaming. It reports whether the downstream
+// handler timed out, w has no status code yet when nothing was written before.
+func (c *DashMiddleware) serveDownstream(w http.ResponseWriter, req *http.Request, stream bool) bool {
+	if c.downstreamTimeout <= 0 {
+		c.next.ServeHTTP(w, req)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), c.downstreamTimeout)
+	defer cancel()
+
+	if stream {
+		return c.serveDownstreamStreaming(ctx, w, req)
+	}
+
+	buffered := &bufferedResponseWriter{header: http.Header{}}
+	done := make(chan struct{})
+	panicChan := c.goDownstream(ctx, buffered, req, done)
+
+	select {
+	case p := <-panicChan:
+		panic(p)
+	case <-done:
+		buffered.mu.Lock()
+		defer buffered.mu.Unlock()
+
+		for key, values := range buffered.header {
+			w.Header()[key] = values
+		}
+		if buffered.statusCode == 0 {
+			buffered.statusCode = http.StatusOK
+		}
+		w.WriteHeader(buffered.statusCode)
+		_, _ = w.Write(buffered.body.Bytes())
+		return false
+	case <-ctx.Done():
+		buffered.mu.Lock()
+		buffered.timedOut = true
+		buffered.mu.Unlock()
+		return true
+	}
+}
+
+// serveDownstreamStreaming runs the next handler writing through to w until ctx is done.
+func (c *DashMiddleware) serveDownstreamStreaming(ctx context.Context, w http.ResponseWriter, req *http.Request) bool {
+	streaming := &streamingTimeoutWriter{w: w, deadline: ctx, header: w.Header().Clone()}
+	done := make(chan struct{})
+	panicChan := c.goDownstream(ctx, streaming, req, done)
+
+	select {
+	case p := <-panicChan:
+		panic(p)
+	case <-done:
+		streaming.mu.Lock()
+		defer streaming.mu.Unlock()
+		if streaming.timedOut || (!streaming.started && streaming.expired()) {
+			return true
+		}
+		// A handler that wrote nothing still answers with its header
+		streaming.start(http.StatusOK)
+		return false
+	case <-ctx.Done():
+		streaming.mu.Lock()
+		streaming.timedOut = true
+		streaming.mu.Unlock()
+		return true
+	}
+}
+
+// goDownstream runs the next handler on its own goroutine, done is closed when it returns
+// and a panic is carried over on the returned channel.
+func (c *DashMiddleware) goDownstream(ctx context.Context, w http.ResponseWriter, req *http.Request, done chan struct{}) <-chan *downstreamPanic {
+	panicChan := make(chan *downstreamPanic, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panicChan <- &downstreamPanic{value: p, stack: debug.Stack()}
+			}
+		}()
+		c.next.ServeHTTP(w, req.WithContext(ctx))
+		close(done)
+	}()
+	return panicChan
+}
+
+// withRequestTimeout bounds the backend calls made for a request by the request timeout when configured.
+func (c *DashMiddleware) withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.requestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.requestTimeout)
+}
+
+// withCallTimeout bounds a single backend call by its own timeout, falling back to the request timeout.
+func (c *DashMiddleware) withCallTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return c.withRequestTimeout(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// writeTimeout answers a request whose deadline fired.
+func writeTimeout(w http.ResponseWriter) {
+	http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+}
+
+// timeoutStage returns the stage of a deadline that failed a backend call: the request one when
+// the RequestTimeout ran out, the given stage for the own bound of the call, empty for other errors.
+func timeoutStage(ctx context.Context, err error, stage string) string {
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return ""
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return timeoutStageRequest
+	}
+	return stage
+}
+
+// timedOut answers a request that is not tracked with the 504, counting the stage that timed out.
+func (c *DashMiddleware) timedOut(w http.ResponseWriter, stage string) {
+	c.logger.Error("Timed out", "stage", stage)
+	c.metrics.inc("dashmiddleware_timeouts_total", "stage", stage)
+	writeTimeout(w)
+}
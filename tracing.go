@@ -0,0 +1,122 @@
+package dashmiddleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// traceparentHeader carries the W3C trace context.
+const traceparentHeader = "Traceparent"
+
+// Names of the spans, stable for dashboards.
+const (
+	spanRequest    = "dashmiddleware.request"
+	spanDownstream = "dashmiddleware.downstream"
+	spanBackend    = "dashmiddleware.backend."
+)
+
+// span a timed operation of a trace, exported or reported through the logger when it ends.
+// Only the W3C trace context is implemented, an SDK cannot be loaded by Yaegi.
+type span struct {
+	name     string
+	traceID  string
+	spanID   string
+	parentID string
+	// flags are the trace-flags of the parent, the trace is only recorded when sampled.
+	flags  string
+	start  time.Time
+	fields []interface{}
+}
+
+// randomHex returns n random bytes hex encoded.
+func randomHex(n int) string {
+	id := make([]byte, n)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// parseTraceparent returns the trace ID, parent span ID and trace-flags of a traceparent header.
+func parseTraceparent(value string) (traceID, parentID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", "", false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2] + parts[3]); err != nil {
+		return "", "", "", false
+	}
+	return parts[1], parts[2], parts[3], true
+}
+
+// startSpan starts a span continuing the trace of a traceparent, or a new trace without one.
+// It returns nil when tracing is disabled.
+func (c *DashMiddleware) startSpan(name, traceparent string) *span {
+	if !c.tracingEnabled {
+		return nil
+	}
+
+	s := &span{name: name, spanID: randomHex(8), start: c.now()}
+	if traceID, parentID, flags, ok := parseTraceparent(traceparent); ok {
+		s.traceID, s.parentID, s.flags = traceID, parentID, flags
+	} else {
+		// A new trace is sampled
+		s.traceID, s.flags = randomHex(16), "01"
+	}
+	return s
+}
+
+// traceparent returns the header value making the span the parent of a call,
+// the sampling decision of the parent is passed on.
+func (s *span) traceparent() string {
+	return "00-" + s.traceID + "-" + s.spanID + "-" + s.flags
+}
+
+// sampled reports whether the trace is recorded, as decided by the parent.
+func (s *span) sampled() bool {
+	flags, err := hex.DecodeString(s.flags)
+	return err == nil && flags[0]&1 == 1
+}
+
+// set adds an attribute to the span.
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.fields = append(s.fields, key, value)
+	}
+}
+
+// endSpan reports a finished span of a sampled trace, it is exported to the tracing endpoint
+// when one is configured and logged otherwise.
+func (c *DashMiddleware) endSpan(s *span) {
+	if s == nil || !s.sampled() {
+		return
+	}
+	if c.tracingEndpoint != "" {
+		c.exportSpan(s, c.now())
+		return
+	}
+
+	fields := append([]interface{}{
+		"span", s.name,
+		"trace_id", s.traceID,
+		"span_id", s.spanID,
+		"parent_id", s.parentID,
+		"duration", c.now().Sub(s.start).Seconds(),
+	}, s.fields...)
+	c.logger.Info("span", fields...)
+}
+
+// startChildSpan starts a span for an outgoing request and makes it the parent of the callee.
+func (c *DashMiddleware) startChildSpan(name string, header http.Header) *span {
+	traceparent := header.Get(traceparentHeader)
+	if traceparent == "" {
+		return nil
+	}
+
+	s := c.startSpan(name, traceparent)
+	if s != nil {
+		header.Set(traceparentHeader, s.traceparent())
+	}
+	return s
+}
@@ -0,0 +1,450 @@
+package dashmiddleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// recordedRequest the state of a recorded request needed to track it.
+type recordedRequest struct {
+	startTime   time.Time
+	body        []byte
+	contentType string
+	// contentEncoding of the request body.
+	contentEncoding string
+	header          http.Header
+	url             string
+	keyURL          string
+	key             string
+	email           []string
+	groups          []string
+	frame           string
+	referer         string
+	refererBase     string
+	isLongCallback  bool
+	clientCert      string
+	sessionID       string
+	remoteAddr      string
+	userAgent       string
+	captureMode     string
+	// traefik is the request metadata passed on by Traefik.
+	traefik map[string]string
+	// propagated are the tracing headers passed on to the backend calls.
+	propagated http.Header
+	// pattern is the RecordedURLs entry the request matched.
+	pattern string
+	// cacheable requests are looked up in and offered to the cache.
+	cacheable bool
+
+	capturingWriter *CapturingResponseWriter
+	cached          bool
+	timeoutStage    string
+	// panicMessage and panicStack describe a panic while serving the request.
+	panicMessage string
+	panicStack   string
+	// aborted is set when the response was aborted with http.ErrAbortHandler.
+	aborted bool
+	// backendFailed is set when the result backend failed and the middleware fails closed.
+	backendFailed      bool
+	lookupDuration     float64
+	downstreamDuration float64
+	// requestBody counts what the downstream read of the body, nil when it did not run.
+	requestBody *countingReader
+
+	// skipTrack is set when the request must not be tracked, e.g. it is not sampled.
+	skipTrack bool
+}
+
+// trackRecorded tracks a recorded request once its response is served.
+// It is deferred, so a response gets tracked even when a later step fails.
+func (c *DashMiddleware) trackRecorded(rec *recordedRequest) {
+	// Latency SLOs are per app, so every served request counts, tracked or not
+	// Near instant cache hits would skew the percentiles of the recomputed results, so they are a series of their own
+	c.metrics.observe("dashmiddleware_request_duration_seconds", c.now().Sub(rec.startTime).Seconds(),
+		"frame", c.frameLabel(rec.frame), "cached", strconv.FormatBool(rec.cached))
+
+	if rec.skipTrack {
+		return
+	}
+
+	// Calculate the duration
+	duration := c.now().Sub(rec.startTime).Seconds()
+	capturingWriter := rec.capturingWriter
+
+	// A client that went away got a partial response, which must not end up in the cache
+	abortErr := capturingWriter.Err
+	if rec.aborted {
+		abortErr = http.ErrAbortHandler
+	}
+	aborted := abortErr != nil
+	if aborted {
+		c.logger.Debug("Failed to write the response to the client", "error", abortErr)
+		if !c.trackAborted {
+			return
+		}
+	}
+
+	contentEncoding := capturingWriter.ResponseWriter.Header().Get("Content-Encoding")
+	var result string
+	var resultErr error
+	var compressionRatio float64
+	switch {
+	case aborted, rec.timeoutStage != "", rec.captureMode != captureModeFull:
+	case capturingWriter.Truncated && (!c.streamResponses || contentEncoding == "gzip"):
+		// A part of a gzip stream cannot be decompressed
+	case contentEncoding == "gzip" && !c.decompressible(len(capturingWriter.Body)):
+		resultErr = fmt.Errorf("compressed result of %d bytes is outside the decompression bounds", len(capturingWriter.Body))
+	case contentEncoding == "gzip":
+		result, resultErr = decompressGzip(capturingWriter.Body, c.maxDecompressedBytes)
+		if resultErr != nil {
+			c.logger.Error("Failed to decompress the result", "error", resultErr)
+		} else if len(result) > 0 {
+			compressionRatio = float64(len(capturingWriter.Body)) / float64(len(result))
+		}
+	default:
+		result = string(capturingWriter.Body)
+	}
+
+	// Strip session specific content so the cached entry can be shared, the client got the original
+	result = normalize(c.resultNormalizers, result)
+
+	// The downstream got the compressed body, the track payload needs something readable
+	requestBody := rec.body
+	if c.decompressRequest && rec.contentEncoding == "gzip" {
+		decompressed, err := decompressGzip(rec.body, c.maxDecompressedBytes)
+		if err != nil {
+			c.logger.Error("Failed to decompress the request body", "error", err)
+		} else {
+			requestBody = []byte(decompressed)
+		}
+	}
+
+	// What the client got, a handler writing nothing results in a 200
+	statusCode := capturingWriter.StatusCode
+	switch {
+	case rec.timeoutStage != "":
+		statusCode = http.StatusGatewayTimeout
+	case statusCode == 0:
+		statusCode = http.StatusOK
+	}
+
+	// The result is offered to the cache under a key honoring the Vary of the downstream response
+	key := rec.key
+	var varied map[string]string
+	vary, varyAll := parseVary(capturingWriter.ResponseWriter.Header().Values("Vary"))
+	if !rec.cached && rec.timeoutStage == "" {
+		vary = c.keyHeaders(vary)
+		c.vary.set(rec.pattern, vary)
+		key = varyKey(c.cacheKey(rec.keyURL, rec.body), rec.header, vary)
+		if len(vary) > 0 {
+			varied = varyValues(rec.header, vary)
+		}
+	}
+
+	// Only complete, successful results are worth recording
+	cacheable := rec.cacheable && !aborted && rec.timeoutStage == "" && rec.panicMessage == "" && resultErr == nil &&
+		!varyAll && !capturingWriter.Truncated &&
+		statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices
+
+	// A cached result replayed with a wrong length corrupts the response, a cache hit was
+	// checked when it was stored and may have been served with injected metadata
+	if cacheable && !rec.cached && rec.captureMode == captureModeFull && !c.checkContentLength(capturingWriter, rec.url) {
+		cacheable = false
+	}
+
+	// Define the JSON payload to send in the request body
+	payload := map[string]interface{}{
+		"Request":     string(requestBody),
+		"Result":      result,
+		"URL":         rec.url,
+		"Key":         key,
+		"Email":       c.trackedEmail(rec.email),
+		"Groups":      rec.groups,
+		"Frame":       rec.frame,
+		"Cached":      rec.cached,
+		"Duration":    duration,
+		"RefererBase": rec.refererBase,
+		"RemoteAddr":  rec.remoteAddr,
+		"UserAgent":   rec.userAgent,
+		"Aborted":     aborted,
+		"StatusCode":  statusCode,
+		"Cacheable":   cacheable,
+		// What went over the wire to the client, for egress attribution
+		"ServedCompressed": contentEncoding != "" && !strings.EqualFold(contentEncoding, "identity"),
+		// The track call happens after the payload is sent, so its duration is not known yet
+		"Timings": map[string]float64{
+			"resultLookup": rec.lookupDuration,
+			"downstream":   rec.downstreamDuration,
+			"track":        0,
+			"total":        duration,
+		},
+	}
+
+	if resultErr != nil {
+		payload["ResultError"] = resultErr.Error()
+	}
+
+	if rec.panicMessage != "" {
+		payload["PanicMessage"] = rec.panicMessage
+		payload["PanicStack"] = rec.panicStack
+	}
+
+	if capturingWriter.Truncated {
+		payload["ResultTruncated"] = true
+	}
+
+	// Sized and hashed as captured, so the backend can deduplicate without hashing large payloads itself
+	if rec.captureMode == captureModeFull && !aborted && !capturingWriter.Truncated {
+		payload["ResultSize"] = len(capturingWriter.Body)
+		if c.resultHasher != nil {
+			payload["ResultHash"] = c.resultHash(capturingWriter.Body)
+		}
+	}
+
+	if c.cacheKeyVersion != "" {
+		payload["KeyVersion"] = c.cacheKeyVersion
+	}
+
+	// The backend stores the entry with the expiry of its frame
+	if ttl := c.cacheTTL(rec.frame); ttl > 0 {
+		payload["TTL"] = ttl.Seconds()
+	}
+
+	if varied != nil {
+		payload["Vary"] = varied
+	}
+
+	if compressionRatio > 0 {
+		payload["CompressionRatio"] = compressionRatio
+	}
+
+	// Binary bodies are not valid UTF-8 and would be mangled in the JSON payload
+	if !utf8.Valid(requestBody) {
+		payload["Request"] = base64.StdEncoding.EncodeToString(requestBody)
+		payload["RequestEncoding"] = "base64"
+	}
+
+	// What the app actually read, the buffered body may be larger
+	if rec.requestBody != nil {
+		payload["RequestBytesConsumed"] = rec.requestBody.consumed()
+	}
+
+	// Uploads are useless as a string and blow up the payload
+	if c.formBodyTracking != formBodyRaw && isFormBody(rec.contentType) {
+		payload["Request"] = ""
+		if c.formBodyTracking == formBodyMetadata {
+			fields, err := formMetadata(rec.contentType, requestBody)
+			if err != nil {
+				c.logger.Debug("Failed to parse the form request body", "error", err)
+			}
+			payload["RequestForm"] = fields
+		}
+	}
+
+	switch rec.captureMode {
+	case captureModeHeaders:
+		delete(payload, "Result")
+		payload["Headers"] = redactCredentials(capturingWriter.ResponseWriter.Header())
+	case captureModeMetadata:
+		delete(payload, "Result")
+	}
+	payload["CaptureMode"] = rec.captureMode
+
+	if rec.timeoutStage != "" {
+		payload["TimeoutStage"] = rec.timeoutStage
+	}
+
+	if len(rec.traefik) > 0 {
+		payload["Traefik"] = rec.traefik
+	}
+	if rec.clientCert != "" {
+		payload["ClientCert"] = rec.clientCert
+	}
+	if rec.sessionID != "" {
+		payload["SessionID"] = rec.sessionID
+	}
+
+	if c.includeReferer {
+		payload["Referer"] = c.redactReferer(rec.referer)
+	}
+
+	// How the result may be cached and what follows its body, whether it came from the app or the cache
+	if cacheHeaders := responseCacheHeaders(capturingWriter.ResponseWriter.Header()); cacheHeaders != nil {
+		payload["CacheHeaders"] = cacheHeaders
+	}
+	if trailers := responseTrailers(capturingWriter.ResponseWriter.Header()); trailers != nil {
+		payload["Trailers"] = trailers
+	}
+
+	// gRPC-Web callbacks report their status in the trailers instead of the status code
+	contentType := capturingWriter.ResponseWriter.Header().Get("Content-Type")
+	if isGrpcWeb(contentType) {
+		var body []byte
+		if rec.captureMode == captureModeFull {
+			body = []byte(result)
+		}
+		if status, ok := grpcWebStatus(capturingWriter.ResponseWriter.Header(), body); ok {
+			payload["GrpcStatus"] = status
+			payload["Error"] = status != 0
+		}
+	}
+
+	// Copy headers from the original request to the new request
+	trackHeader := http.Header{}
+	copyHeader(trackHeader, rec.propagated)
+	if expires := c.validExpires(capturingWriter.ResponseWriter.Header().Get("Expires")); expires != "" {
+		trackHeader.Set("Expires", expires)
+	}
+
+	// Set the Content-Type header for the new request
+	trackHeader.Set("Content-Type", contentType)
+
+	// Check if the data is compressed, the Result is always decompressed so the header only tells how it was served
+	if contentEncoding == "gzip" && !c.decodeTrackBody {
+		trackHeader.Set("Content-Encoding", "gzip")
+	}
+
+	// Retries of this event carry the same key, so the backend can record it only once
+	trackHeader.Set("Idempotency-Key", idempotencyKey(key, rec.startTime))
+
+	c.track(c.trackURLFor(rec.isLongCallback, rec.frame), payload, trackHeader)
+}
+
+// track sends the payload of a recorded request to the track backend.
+func (c *DashMiddleware) track(trackURL string, payload map[string]interface{}, header http.Header) {
+	// Marshal the payload into a JSON string
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		c.logger.Error("Failed to create JSON payload", "error", err)
+		return
+	}
+
+	// The backend rejects payloads above its limit, so do not even try to send them
+	if c.maxTrackPayloadBytes > 0 && len(payloadJSON) > c.maxTrackPayloadBytes {
+		if c.oversizedTrack == oversizedTrackDrop {
+			c.metrics.inc("dashmiddleware_track_dropped_total", "reason", "payload_too_large")
+			c.logger.Info("Dropping oversized track payload", "bytes", len(payloadJSON), "limit", c.maxTrackPayloadBytes)
+			return
+		}
+
+		delete(payload, "Result")
+		payload["ResultOmitted"] = true
+		payloadJSON, err = json.Marshal(payload)
+		if err != nil {
+			c.logger.Error("Failed to create JSON payload", "error", err)
+			return
+		}
+		if len(payloadJSON) > c.maxTrackPayloadBytes {
+			c.metrics.inc("dashmiddleware_track_dropped_total", "reason", "payload_too_large")
+			c.logger.Info("Dropping oversized metadata track payload", "bytes", len(payloadJSON), "limit", c.maxTrackPayloadBytes)
+			return
+		}
+	}
+
+	if c.trackQueue != nil {
+		c.enqueueTrack(trackJob{url: trackURL, payload: payloadJSON, header: header})
+		return
+	}
+	c.deliverTrack(trackURL, payloadJSON, header)
+}
+
+// deliverTrack sends a marshaled track payload, retrying transient failures.
+func (c *DashMiddleware) deliverTrack(trackURL string, payloadJSON []byte, header http.Header) {
+	for attempt := 0; ; attempt++ {
+		retry := c.sendTrack(trackURL, payloadJSON, header)
+		if !retry || attempt >= c.trackRetries {
+			return
+		}
+		c.logger.Info("Retrying track request", "attempt", attempt+1, "retries", c.trackRetries)
+		// A closed middleware does not wait for retries, the track request is given up
+		if !c.backoff(c.stopping, attempt) {
+			c.logger.Error("Giving up the track request, the middleware is closed", "attempt", attempt+1)
+			return
+		}
+	}
+}
+
+// sendTrack posts a marshaled track payload once and reports whether it is worth retrying.
+func (c *DashMiddleware) sendTrack(trackURL string, payloadJSON []byte, header http.Header) bool {
+	// Tracking happens after the response was served, the client going away must not cancel it
+	ctx, cancel := c.withCallTimeout(context.Background(), c.trackTimeout)
+	defer cancel()
+
+	// Create a new request for the external REST API
+	trackReq, err := http.NewRequestWithContext(ctx, http.MethodPost, trackURL, bytes.NewBuffer(payloadJSON))
+	if err != nil {
+		c.logger.Error("Failed to create the track request", "error", err)
+		return false
+	}
+	for key, values := range header {
+		for _, value := range values {
+			trackReq.Header.Add(key, value)
+		}
+	}
+	c.authorize(trackReq)
+
+	// Make a request to the external REST API with headers from the original request
+	resp, err := c.doBackend(backendTrack, trackReq)
+	if err != nil {
+		c.logger.Error("Failed to track request", "error", err, "url", trackURL, "contentType", header.Get("Content-Type"), "encoding", header.Get("Content-Encoding"))
+		return true
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			c.logger.Debug("Failed to close response", "error", closeErr)
+		}
+	}()
+
+	// Check the response status code from the external API
+	if resp.StatusCode != http.StatusOK {
+		c.logger.Error("Failed to track request", "status", resp.StatusCode)
+		return resp.StatusCode >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// decompressible reports whether a compressed result is within the bounds worth decompressing.
+func (c *DashMiddleware) decompressible(size int) bool {
+	if c.decompressMinBytes > 0 && int64(size) < c.decompressMinBytes {
+		return false
+	}
+	return c.decompressMaxBytes <= 0 || int64(size) <= c.decompressMaxBytes
+}
+
+// validExpires returns the Expires header for the track request, empty when it has to be dropped.
+func (c *DashMiddleware) validExpires(expires string) string {
+	if expires == "" {
+		return ""
+	}
+	if _, err := http.ParseTime(expires); err != nil {
+		c.malformedExpiresOnce.Do(func() {
+			c.logger.Debug("Dropping malformed Expires header", "expires", expires, "error", err)
+		})
+		return ""
+	}
+	return expires
+}
+
+// credentialHeaders carry sessions or secrets, their values never reach the track backend.
+var credentialHeaders = []string{"Set-Cookie", "Set-Cookie2", "Cookie", "Authorization", "Proxy-Authorization"}
+
+// redactCredentials returns a copy of the header whose credential values are REDACTED, so the
+// tracked headers still tell e.g. that a cookie was set.
+func redactCredentials(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range credentialHeaders {
+		values := redacted[name]
+		for i := range values {
+			values[i] = "REDACTED"
+		}
+	}
+	return redacted
+}
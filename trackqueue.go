@@ -0,0 +1,143 @@
+package dashmiddleware
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Policies of a full track queue.
+const (
+	trackQueueDropNewest = "newest"
+	trackQueueDropOldest = "oldest"
+)
+
+// trackJob a marshaled track request waiting to be sent.
+type trackJob struct {
+	url     string
+	payload []byte
+	header  http.Header
+}
+
+// trackQueue the track requests waiting to be sent asynchronously, bounded by count and bytes.
+type trackQueue struct {
+	mu     sync.Mutex
+	ready  *sync.Cond
+	jobs   []trackJob
+	bytes  int64
+	closed bool
+
+	maxJobs    int
+	maxBytes   int64
+	dropOldest bool
+}
+
+func newTrackQueue(maxJobs int, maxBytes int64, dropOldest bool) *trackQueue {
+	q := &trackQueue{maxJobs: maxJobs, maxBytes: maxBytes, dropOldest: dropOldest}
+	q.ready = sync.NewCond(&q.mu)
+	return q
+}
+
+// full reports whether one more job of the given size exceeds a limit.
+func (q *trackQueue) full(size int64) bool {
+	if q.maxJobs > 0 && len(q.jobs) >= q.maxJobs {
+		return true
+	}
+	return q.maxBytes > 0 && q.bytes+size > q.maxBytes
+}
+
+// push queues a job and returns how many jobs were dropped to respect the limits, which may include it.
+// It returns false when the queue is closed and the job was dropped for that.
+func (q *trackQueue) push(job trackJob) (int, bool) {
+	size := int64(len(job.payload))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 1, false
+	}
+
+	// A job larger than the queue never fits, it must not evict the others first
+	if q.maxBytes > 0 && size > q.maxBytes {
+		return 1, true
+	}
+
+	dropped := 0
+	for q.full(size) {
+		if !q.dropOldest || len(q.jobs) == 0 {
+			return dropped + 1, true
+		}
+		q.bytes -= int64(len(q.jobs[0].payload))
+		q.jobs[0] = trackJob{}
+		q.jobs = q.jobs[1:]
+		dropped++
+	}
+
+	q.jobs = append(q.jobs, job)
+	q.bytes += size
+	q.ready.Signal()
+	return dropped, true
+}
+
+// pop waits for the next job, it returns false once the queue is closed and empty.
+func (q *trackQueue) pop() (trackJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 && !q.closed {
+		q.ready.Wait()
+	}
+	if len(q.jobs) == 0 {
+		return trackJob{}, false
+	}
+
+	job := q.jobs[0]
+	q.jobs[0] = trackJob{}
+	q.jobs = q.jobs[1:]
+	q.bytes -= int64(len(job.payload))
+	return job, true
+}
+
+// close stops accepting jobs, the queued ones are still handed out.
+func (q *trackQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.ready.Broadcast()
+}
+
+// enqueueTrack hands a track request to the queue worker, counting what the queue limits drop.
+func (c *DashMiddleware) enqueueTrack(job trackJob) {
+	dropped, open := c.trackQueue.push(job)
+	if !open {
+		c.logger.Info("Dropping a track request, the middleware is closed")
+		c.metrics.inc("dashmiddleware_track_dropped_total", "reason", "closed")
+		return
+	}
+	if dropped > 0 {
+		c.logger.Info("Dropping track requests, the track queue is full", "dropped", dropped)
+	}
+	for ; dropped > 0; dropped-- {
+		c.metrics.inc("dashmiddleware_track_dropped_total", "reason", "queue_full")
+	}
+}
+
+// runTrackQueue sends the queued track requests until the queue is closed and empty,
+// every track worker runs it.
+func (c *DashMiddleware) runTrackQueue() {
+	defer c.trackWorkersDone.Done()
+	for {
+		job, ok := c.trackQueue.pop()
+		if !ok {
+			return
+		}
+		c.deliverTrack(job.url, job.payload, job.header)
+	}
+}
+
+// flushTrackQueue stops accepting track requests and waits until the queued ones were sent.
+func (c *DashMiddleware) flushTrackQueue() {
+	if c.trackQueue == nil {
+		return
+	}
+	c.trackQueue.close()
+	c.trackWorkersDone.Wait()
+}
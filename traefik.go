@@ -0,0 +1,30 @@
+package dashmiddleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultTraefikHeaders the request metadata Traefik can be configured to pass on.
+var defaultTraefikHeaders = []string{"X-Traefik-Router", "X-Traefik-Entrypoint", "X-Traefik-Service"}
+
+// traefikMetadata collects the configured Traefik headers present on the request,
+// keyed by the header name without its X-Traefik- prefix.
+func (c *DashMiddleware) traefikMetadata(header http.Header) map[string]string {
+	var metadata map[string]string
+	for _, name := range c.traefikHeaders {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		canonical := http.CanonicalHeaderKey(name)
+		if trimmed := strings.TrimPrefix(canonical, "X-Traefik-"); trimmed != "" {
+			canonical = trimmed
+		}
+		metadata[canonical] = value
+	}
+	return metadata
+}
@@ -0,0 +1,27 @@
+package dashmiddleware
+
+import (
+	"fmt"
+	"time"
+)
+
+// parseFrameCacheTTLs parses the per frame cache TTLs of the config.
+func parseFrameCacheTTLs(ttls map[string]string) (map[string]time.Duration, error) {
+	parsed := make(map[string]time.Duration, len(ttls))
+	for frame, value := range ttls {
+		ttl, err := parseDuration(fmt.Sprintf("framecachettl of frame %q", frame), value)
+		if err != nil {
+			return nil, err
+		}
+		parsed[frame] = ttl
+	}
+	return parsed, nil
+}
+
+// cacheTTL returns the TTL the backend stores the results of a frame with, 0 leaves it to the backend.
+func (c *DashMiddleware) cacheTTL(frame string) time.Duration {
+	if ttl, ok := c.frameCacheTTLs[frame]; ok {
+		return ttl
+	}
+	return c.defaultCacheTTL
+}
@@ -0,0 +1,52 @@
+package dashmiddleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+)
+
+// sampleCacheValidation decides whether a cache hit is recomputed to validate the cache.
+func (c *DashMiddleware) sampleCacheValidation() bool {
+	return c.cacheValidationSampleRate > 0 && rand.Float64() < c.cacheValidationSampleRate
+}
+
+// validateCached recomputes a cache hit downstream in the background and compares it to the cached result.
+// The client already got the cached result, a mismatch is only logged and counted.
+func (c *DashMiddleware) validateCached(req *http.Request, body []byte, pattern string, cached []byte) {
+	// The recompute outlives the request, but not the middleware
+	shadow := req.Clone(c.lifecycle)
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+
+	c.goBackground(func() {
+		defer func() {
+			if p := recover(); p != nil {
+				c.logger.Error("Cache validation panicked", "url", shadow.URL.String(), "panic", fmt.Sprint(p))
+			}
+		}()
+
+		writer := &bufferedResponseWriter{header: http.Header{}}
+		c.next.ServeHTTP(writer, shadow)
+		if writer.statusCode != 0 && writer.statusCode != http.StatusOK {
+			return
+		}
+
+		result := writer.body.String()
+		if writer.header.Get("Content-Encoding") == "gzip" {
+			decompressed, err := decompressGzip(writer.body.Bytes(), c.maxDecompressedBytes)
+			if err != nil {
+				c.logger.Error("Failed to decompress the recomputed result", "error", err)
+				return
+			}
+			result = decompressed
+		}
+
+		if normalize(c.resultNormalizers, result) != string(cached) {
+			c.logger.Error("Cached result differs from the recomputed one", "url", shadow.URL.String())
+			c.metrics.inc("dashmiddleware_cache_validation_mismatches_total", "pattern", pattern)
+		}
+		c.metrics.inc("dashmiddleware_cache_validations_total", "pattern", pattern)
+	})
+}
@@ -0,0 +1,79 @@
+package dashmiddleware
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// varyHeaders remembers per recorded URL pattern the request headers its responses vary on,
+// so a lookup uses the same key the result was offered to the cache with.
+type varyHeaders struct {
+	mu        sync.Mutex
+	byPattern map[string][]string
+}
+
+func newVaryHeaders() *varyHeaders {
+	return &varyHeaders{byPattern: map[string][]string{}}
+}
+
+func (v *varyHeaders) get(pattern string) []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.byPattern[pattern]
+}
+
+func (v *varyHeaders) set(pattern string, headers []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(headers) == 0 {
+		delete(v.byPattern, pattern)
+		return
+	}
+	v.byPattern[pattern] = headers
+}
+
+// parseVary returns the sorted canonical header names listed in Vary values,
+// all reports a Vary of * which matches no other request.
+func parseVary(values []string) (headers []string, all bool) {
+	seen := map[string]bool{}
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			switch {
+			case name == "*":
+				return nil, true
+			case name != "" && !seen[http.CanonicalHeaderKey(name)]:
+				seen[http.CanonicalHeaderKey(name)] = true
+				headers = append(headers, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(headers)
+	return headers, false
+}
+
+// keyHeaders drops the volatile headers that must never be part of a key.
+func (c *DashMiddleware) keyHeaders(headers []string) []string {
+	if len(c.keyExcludeHeaders) == 0 {
+		return headers
+	}
+
+	kept := make([]string, 0, len(headers))
+	for _, name := range headers {
+		if !c.keyExcludeHeaders[name] {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// varyValues returns the values of the varied request headers.
+func varyValues(header http.Header, vary []string) map[string]string {
+	values := make(map[string]string, len(vary))
+	for _, name := range vary {
+		values[name] = strings.Join(header.Values(name), ",")
+	}
+	return values
+}
@@ -0,0 +1,79 @@
+package dashmiddleware
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// WarmRequest a request replayed through the middleware to populate the cache.
+// Referer is optional and names the frame the result is cached for.
+type WarmRequest struct {
+	URL     string `json:"url"`
+	Body    string `json:"body"`
+	Email   string `json:"email"`
+	Referer string `json:"referer"`
+}
+
+// warmContextKey marks the requests sent by Warm, which come from the operator and not from
+// a browser, so the referer checks do not apply to them.
+type warmContextKey struct{}
+
+func isWarmRequest(req *http.Request) bool {
+	return req.Context().Value(warmContextKey{}) != nil
+}
+
+// warmResponseWriter discards the response of a warm request but keeps its status.
+type warmResponseWriter struct {
+	header     http.Header
+	statusCode int
+}
+
+func (w *warmResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *warmResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *warmResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+// Warm runs the requests through the downstream and track pipeline without a client,
+// so the results are cached before the first user asks for them.
+func (c *DashMiddleware) Warm(ctx context.Context, requests []WarmRequest) error {
+	for _, warmRequest := range requests {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(context.WithValue(ctx, warmContextKey{}, true), http.MethodPost, warmRequest.URL, bytes.NewBufferString(warmRequest.Body))
+		if err != nil {
+			return fmt.Errorf("failed to create warm request for %s: %w", warmRequest.URL, err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if warmRequest.Email != "" {
+			req.Header.Set(c.emailHeaders[0], warmRequest.Email)
+		}
+		if warmRequest.Referer != "" {
+			req.Header.Set("Referer", warmRequest.Referer)
+		}
+
+		writer := &warmResponseWriter{header: http.Header{}}
+		c.ServeHTTP(writer, req)
+
+		if writer.statusCode >= http.StatusBadRequest {
+			return fmt.Errorf("failed to warm %s: status code %d", warmRequest.URL, writer.statusCode)
+		}
+	}
+
+	return nil
+}